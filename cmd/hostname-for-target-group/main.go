@@ -2,33 +2,53 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/sts"
 
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/cresta/gotracing"
 	"github.com/cresta/gotracing/datadog"
+	"github.com/cresta/hostname-for-target-group/internal/audit"
+	"github.com/cresta/hostname-for-target-group/internal/kube"
+	"github.com/cresta/hostname-for-target-group/internal/leader"
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+	"github.com/cresta/hostname-for-target-group/internal/notify"
 	"github.com/cresta/hostname-for-target-group/internal/state"
 	"github.com/cresta/hostname-for-target-group/internal/syncer"
 	"github.com/cresta/httpsimple"
 	"github.com/cresta/zapctx"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/signalfx/golib/v3/httpdebug"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
 )
 
 type config struct {
@@ -36,18 +56,74 @@ type config struct {
 	DebugListenAddr                 string
 	Tracer                          string
 	DynamoDBTable                   string
+	StateFile                       string
 	TgFromTagKey                    string
+	KubernetesBindings              string
+	ConfigFile                      string
+	KubernetesBindingsNamespace     string
 	DNSServers                      string
+	DNSTimeout                      string
+	DNSCABundle                     string
+	DNSQuorum                       string
+	DNSServerFailures               string
+	DNSServerCooldown               string
 	InvocationsBeforeDeregistration string
 	RemoveUnknownTgIP               string
+	UnhealthyInvocations            string
 	DaemonMode                      string
 	DNSRefreshInterval              string
+	DNSTTLScheduling                string
+	DNSMinRefreshInterval           string
+	DNSMaxRefreshInterval           string
 	TagSearchInterval               string
+	TagSearchLocations              string
 	ElbTgArn                        string
 	TargetFqdn                      string
+	TargetPort                      string
+	TargetAvailabilityZone          string
 	LambdaMode                      string
 	TagCachePrefix                  string
 	LogLevel                        string
+	DryRun                          string
+	SyncConcurrency                 string
+	TargetGroupSyncTimeout          string
+	MaxRemovalCount                 string
+	MaxRemovalPercent               string
+	MinTargets                      string
+	LeaderElection                  string
+	LeaderLeaseDuration             string
+	LeaderIdentity                  string
+	AuditLogFile                    string
+	AuditLogStdout                  string
+	AuditDynamoDBTable              string
+	NotifyWebhookURL                string
+	NotifyWebhookSecret             string
+	NotifySlackWebhookURL           string
+	NotifySNSTopicARN               string
+	NotifyInterval                  string
+	NotifyFailures                  string
+	DeregisterOnCNAMEChange         string
+}
+
+// MarshalLogObject logs every setting, with secrets redacted
+func (c config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i).String()
+		if _, secret := secretConfig[name]; secret && value != "" {
+			value = "REDACTED"
+		}
+		enc.AddString(name, value)
+	}
+	return nil
+}
+
+// secretConfig are the config fields that are never logged.  Webhook URLs often carry a token.
+var secretConfig = map[string]struct{}{
+	"NotifyWebhookURL":      {},
+	"NotifyWebhookSecret":   {},
+	"NotifySlackWebhookURL": {},
 }
 
 func (c config) WithDefaults() config {
@@ -60,6 +136,21 @@ func (c config) WithDefaults() config {
 	if c.DNSRefreshInterval == "" {
 		c.DNSRefreshInterval = "5s"
 	}
+	if c.DNSMinRefreshInterval == "" {
+		c.DNSMinRefreshInterval = c.DNSRefreshInterval
+	}
+	if c.DNSMaxRefreshInterval == "" {
+		c.DNSMaxRefreshInterval = "5m"
+	}
+	if c.DNSTimeout == "" {
+		c.DNSTimeout = "2s"
+	}
+	if c.DNSServerFailures == "" {
+		c.DNSServerFailures = "3"
+	}
+	if c.DNSServerCooldown == "" {
+		c.DNSServerCooldown = "30s"
+	}
 	if c.TagSearchInterval == "" {
 		c.TagSearchInterval = "60s"
 	}
@@ -72,6 +163,21 @@ func (c config) WithDefaults() config {
 	if c.LogLevel == "" {
 		c.LogLevel = "INFO"
 	}
+	if c.SyncConcurrency == "" {
+		c.SyncConcurrency = "10"
+	}
+	if c.TargetGroupSyncTimeout == "" {
+		c.TargetGroupSyncTimeout = "30s"
+	}
+	if c.LeaderLeaseDuration == "" {
+		c.LeaderLeaseDuration = "30s"
+	}
+	if c.NotifyInterval == "" {
+		c.NotifyInterval = "1m"
+	}
+	if c.NotifyFailures == "" {
+		c.NotifyFailures = "3"
+	}
 	return c
 }
 
@@ -93,6 +199,208 @@ func (c config) getInvocationsBeforeDeregistration(ctx context.Context, logger *
 	return i
 }
 
+func (c config) getUnhealthyInvocations(ctx context.Context, logger *zapctx.Logger) int {
+	if c.UnhealthyInvocations == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(c.UnhealthyInvocations)
+	if err != nil || i < 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse UNHEALTHY_INVOCATIONS_BEFORE_DEREGISTRATION: defaulting to never", zap.String("env", c.UnhealthyInvocations))
+		return 0
+	}
+	return i
+}
+
+func (c config) getSyncConcurrency(ctx context.Context, logger *zapctx.Logger) int {
+	i, err := strconv.Atoi(c.SyncConcurrency)
+	if err != nil || i < 1 {
+		logger.IfErr(err).Warn(ctx, "unable to parse SYNC_CONCURRENCY: defaulting to 10", zap.String("env", c.SyncConcurrency))
+		return 10
+	}
+	return i
+}
+
+func (c config) getTargetGroupSyncTimeout(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.TargetGroupSyncTimeout)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse TARGET_GROUP_SYNC_TIMEOUT: defaulting to 30s", zap.String("env", c.TargetGroupSyncTimeout))
+		return time.Second * 30
+	}
+	return i
+}
+
+func (c config) getMaxRemovalCount(ctx context.Context, logger *zapctx.Logger) int {
+	if c.MaxRemovalCount == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(c.MaxRemovalCount)
+	if err != nil || i < 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse MAX_REMOVAL_COUNT: defaulting to no limit", zap.String("env", c.MaxRemovalCount))
+		return 0
+	}
+	return i
+}
+
+func (c config) getMaxRemovalPercent(ctx context.Context, logger *zapctx.Logger) float64 {
+	if c.MaxRemovalPercent == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(c.MaxRemovalPercent, 64)
+	if err != nil || f < 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse MAX_REMOVAL_PERCENT: defaulting to no limit", zap.String("env", c.MaxRemovalPercent))
+		return 0
+	}
+	return f
+}
+
+func (c config) getMinTargets(ctx context.Context, logger *zapctx.Logger) int {
+	if c.MinTargets == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(c.MinTargets)
+	if err != nil || i < 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse MIN_TARGETS: defaulting to no floor", zap.String("env", c.MinTargets))
+		return 0
+	}
+	return i
+}
+
+func (c config) getDNSMinRefreshInterval(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.DNSMinRefreshInterval)
+	if err != nil || i <= 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_MIN_REFRESH_INTERVAL: defaulting to 5s", zap.String("env", c.DNSMinRefreshInterval))
+		return time.Second * 5
+	}
+	return i
+}
+
+func (c config) getDNSMaxRefreshInterval(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.DNSMaxRefreshInterval)
+	if err != nil || i <= 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_MAX_REFRESH_INTERVAL: defaulting to 5m", zap.String("env", c.DNSMaxRefreshInterval))
+		return time.Minute * 5
+	}
+	return i
+}
+
+func (c config) getDNSTimeout(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.DNSTimeout)
+	if err != nil || i <= 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_TIMEOUT: defaulting to 2s", zap.String("env", c.DNSTimeout))
+		return time.Second * 2
+	}
+	return i
+}
+
+func (c config) getDNSQuorum(ctx context.Context, logger *zapctx.Logger) syncer.Quorum {
+	q, err := syncer.ParseQuorum(c.DNSQuorum)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_QUORUM: defaulting to first", zap.String("env", c.DNSQuorum))
+		return syncer.QuorumFirst
+	}
+	return q
+}
+
+func (c config) getDNSServerFailures(ctx context.Context, logger *zapctx.Logger) int {
+	i, err := strconv.Atoi(c.DNSServerFailures)
+	if err != nil || i <= 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_SERVER_FAILURES: defaulting to 3", zap.String("env", c.DNSServerFailures))
+		return 3
+	}
+	return i
+}
+
+func (c config) getDNSServerCooldown(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.DNSServerCooldown)
+	if err != nil || i <= 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_SERVER_COOLDOWN: defaulting to 30s", zap.String("env", c.DNSServerCooldown))
+		return time.Second * 30
+	}
+	return i
+}
+
+func (c config) getDNSTTLScheduling(ctx context.Context, logger *zapctx.Logger) bool {
+	if c.DNSTTLScheduling == "" {
+		return false
+	}
+	ret, err := strconv.ParseBool(c.DNSTTLScheduling)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse DNS_TTL_SCHEDULING, defaulting to false", zap.String("DNSTTLScheduling", c.DNSTTLScheduling))
+	}
+	return ret
+}
+
+func (c config) getLeaderLeaseDuration(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.LeaderLeaseDuration)
+	if err != nil || i <= 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse LEADER_LEASE_DURATION: defaulting to 30s", zap.String("env", c.LeaderLeaseDuration))
+		return time.Second * 30
+	}
+	return i
+}
+
+func (c config) getDryRun(ctx context.Context, logger *zapctx.Logger) bool {
+	if c.DryRun == "" {
+		return false
+	}
+	ret, err := strconv.ParseBool(c.DryRun)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse DRY_RUN, defaulting to false", zap.String("DryRun", c.DryRun))
+	}
+	return ret
+}
+
+func (c config) getKubernetesBindings(ctx context.Context, logger *zapctx.Logger) bool {
+	if c.KubernetesBindings == "" {
+		return false
+	}
+	ret, err := strconv.ParseBool(c.KubernetesBindings)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse KUBERNETES_BINDINGS, defaulting to false", zap.String("KubernetesBindings", c.KubernetesBindings))
+	}
+	return ret
+}
+
+func (c config) getNotifyInterval(ctx context.Context, logger *zapctx.Logger) time.Duration {
+	i, err := time.ParseDuration(c.NotifyInterval)
+	if err != nil || i < 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse NOTIFY_INTERVAL: defaulting to 1m", zap.String("env", c.NotifyInterval))
+		return time.Minute
+	}
+	return i
+}
+
+func (c config) getNotifyFailures(ctx context.Context, logger *zapctx.Logger) int {
+	i, err := strconv.Atoi(c.NotifyFailures)
+	if err != nil || i < 0 {
+		logger.IfErr(err).Warn(ctx, "unable to parse NOTIFY_FAILURES: defaulting to 3", zap.String("env", c.NotifyFailures))
+		return 3
+	}
+	return i
+}
+
+func (c config) getDeregisterOnCNAMEChange(ctx context.Context, logger *zapctx.Logger) bool {
+	if c.DeregisterOnCNAMEChange == "" {
+		return false
+	}
+	ret, err := strconv.ParseBool(c.DeregisterOnCNAMEChange)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse DEREGISTER_ON_CNAME_CHANGE, defaulting to false", zap.String("DeregisterOnCNAMEChange", c.DeregisterOnCNAMEChange))
+	}
+	return ret
+}
+
+func (c config) getAuditLogStdout(ctx context.Context, logger *zapctx.Logger) bool {
+	if c.AuditLogStdout == "" {
+		return false
+	}
+	ret, err := strconv.ParseBool(c.AuditLogStdout)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to parse AUDIT_LOG_STDOUT, defaulting to false", zap.String("AuditLogStdout", c.AuditLogStdout))
+	}
+	return ret
+}
+
 func (c config) getRemoveUnknownTgIP(ctx context.Context, logger *zapctx.Logger) bool {
 	ret, err := strconv.ParseBool(c.RemoveUnknownTgIP)
 	if err != nil {
@@ -109,32 +417,126 @@ func getConfig() config {
 		DebugListenAddr: os.Getenv("DEBUG_ADDR"),
 		// Allows you to use a dynamic tracer
 		Tracer: os.Getenv("TRACER"),
-		// Which dynamodb table to write/read sync results from/to
+		// Which dynamodb table to write/read sync results from/to.  Enable TTL on the ExpireAt attribute so DynamoDB
+		// removes expired tag caches and leader leases
 		DynamoDBTable: os.Getenv("DYNAMODB_TABLE"),
+		// A local JSON file to write/read sync results from/to instead of dynamodb.  Useful for dev and CI
+		StateFile: os.Getenv("STATE_FILE"),
 		// The target group to monitor.  Overridden by TG_FROM_TAG_KEY
 		ElbTgArn: os.Getenv("ELB_TG_ARN"),
-		// The host to resolve ElbTgArn into.  Overridden by TG_FROM_TAG_KEY
+		// The hosts to resolve ElbTgArn into, comma separated.  Hosts prefixed with "srv:" are resolved through SRV
+		// records into targets with the records' ports.  Overridden by TG_FROM_TAG_KEY
 		TargetFqdn: os.Getenv("TARGET_FQDN"),
-		// If set, will search for Target groups with this tag key and sync the IPs of that target group
+		// Optional: The port to register TARGET_FQDN IPs with.  Defaults to the target group's port
+		TargetPort: os.Getenv("TARGET_PORT"),
+		// Optional: The availability zone to register TARGET_FQDN IPs with.  Use "all" for IPs outside the VPC
+		TargetAvailabilityZone: os.Getenv("TARGET_AVAILABILITY_ZONE"),
+		// If set, will search for Target groups with this tag key and sync the IPs of that target group.  The tag value
+		// is a space separated list of hostnames, optionally with port=<port> and az=<availability zone>.  The tags
+		// <key>/invocations-before-deregistration, <key>/remove-unknown, and <key>/min-targets override
+		// INVOCATIONS_BEFORE_DEREGISTRATION, REMOVE_UNKNOWN_TG_IP, and MIN_TARGETS for that target group
 		TgFromTagKey: os.Getenv("TG_FROM_TAG_KEY"),
-		// Comma separated list of DNS servers to query
+		// If true, will sync the target groups of TargetGroupHostnameBinding resources in the kubernetes cluster this
+		// runs in.  Overrides TG_FROM_TAG_KEY
+		KubernetesBindings: os.Getenv("KUBERNETES_BINDINGS"),
+		// Optional: Only watch TargetGroupHostnameBinding resources in this namespace.  Defaults to every namespace
+		KubernetesBindingsNamespace: os.Getenv("KUBERNETES_BINDINGS_NAMESPACE"),
+		// A YAML or JSON file listing the target groups to sync and their hostnames and options.  Overrides
+		// TG_FROM_TAG_KEY.  Daemon mode reloads it when it changes or on SIGHUP
+		ConfigFile: os.Getenv("CONFIG_FILE"),
+		// Comma separated list of DNS servers to query.  Servers are host[:port] for plain DNS,
+		// tls://host[:port] for DNS over TLS, or https:// URLs for DNS over HTTPS.  Defaults to the nameservers of
+		// /etc/resolv.conf.  Either way, /etc/hosts and the search domains of /etc/resolv.conf are used too
 		DNSServers: os.Getenv("DNS_SERVERS"),
+		// Optional: The timeout of each DNS query.  Defaults to 2s
+		DNSTimeout: os.Getenv("DNS_TIMEOUT"),
+		// Optional: A PEM file of CA certificates to trust, along with the system's, for tls:// and https:// DNS servers
+		DNSCABundle: os.Getenv("DNS_CA_BUNDLE"),
+		// Optional: How to combine the answers of DNS_SERVERS.  "first" uses the first server to answer.  "union",
+		// "intersection", or "majority" ask every server at once and use the addresses any, all, or most of them
+		// returned.  Defaults to first
+		DNSQuorum: os.Getenv("DNS_QUORUM"),
+		// Optional: Skip a DNS server for DNS_SERVER_COOLDOWN after it fails this many lookups in a row.  Defaults to 3
+		DNSServerFailures: os.Getenv("DNS_SERVER_FAILURES"),
+		// Optional: How long to skip a failing DNS server.  Defaults to 30s.  The health of each server is reported at
+		// /debug/resolvers on DEBUG_ADDR
+		DNSServerCooldown: os.Getenv("DNS_SERVER_COOLDOWN"),
 		// If set, will require this many invocations before deregistring an IP
 		InvocationsBeforeDeregistration: os.Getenv("INVOCATIONS_BEFORE_DEREGISTRATION"),
 		// If true, will also remove IPs from the target group that never had a state
 		RemoveUnknownTgIP: os.Getenv("REMOVE_UNKNOWN_TG_IP"),
+		// Optional: Deregister targets that fail health checks this many syncs in a row, even if DNS still returns them.
+		// They are registered again after as many syncs.  Defaults to never
+		UnhealthyInvocations: os.Getenv("UNHEALTHY_INVOCATIONS_BEFORE_DEREGISTRATION"),
 		// If true, will run the service continuously, sleeping DNS_REFRESH_INTERVAL
 		DaemonMode: os.Getenv("DAEMON_MODE"),
 		// When in daemon mode, will sleep this long between refreshes
 		DNSRefreshInterval: os.Getenv("DNS_REFRESH_INTERVAL"),
+		// If true, daemon mode re-syncs each target group when the DNS TTL of its hostnames expires instead of every
+		// DNS_REFRESH_INTERVAL.  TTLs are unknown for names in /etc/hosts, or if /etc/resolv.conf lists no nameservers
+		// and DNS_SERVERS is unset
+		DNSTTLScheduling: os.Getenv("DNS_TTL_SCHEDULING"),
+		// With DNS_TTL_SCHEDULING, the soonest a target group is re-synced.  Also used for unknown TTLs and failed
+		// syncs.  Defaults to DNS_REFRESH_INTERVAL
+		DNSMinRefreshInterval: os.Getenv("DNS_MIN_REFRESH_INTERVAL"),
+		// With DNS_TTL_SCHEDULING, the longest a target group goes without a re-sync.  Defaults to 5m
+		DNSMaxRefreshInterval: os.Getenv("DNS_MAX_REFRESH_INTERVAL"),
 		// If using mode TG_FROM_TAG_KEY, the interval between searching for tags
 		// This can be useful since the tags change very infrequently
 		TagSearchInterval: os.Getenv("TAG_SEARCH_INTERVAL"),
+		// If using mode TG_FROM_TAG_KEY, other accounts and regions to also search for tagged target groups, as a comma
+		// separated list of <region>=<role arn>.  The role is assumed to manage the target groups found there, and is
+		// optional for regions of this account.
+		TagSearchLocations: os.Getenv("TAG_SEARCH_LOCATIONS"),
 		// If true, will run as a lambda handler.  Overwrites DAEMON_MODE setting and ignores DNS_REFRESH_INTERVAL
 		LambdaMode: os.Getenv("LAMBDA_MODE"),
 		// Optional: Adds a prefix key to fetches for tag cache.
 		TagCachePrefix: os.Getenv("TAG_CACHE_PREFIX"),
 		LogLevel:       os.Getenv("LOG_LEVEL"),
+		// If true, will log the changes each sync would make without changing target groups or stored state
+		DryRun: os.Getenv("DRY_RUN"),
+		// How many target groups to sync at once.  Defaults to 10
+		SyncConcurrency: os.Getenv("SYNC_CONCURRENCY"),
+		// The longest a single target group can take to sync, so one slow hostname cannot hold up the rest.  Defaults to 30s
+		TargetGroupSyncTimeout: os.Getenv("TARGET_GROUP_SYNC_TIMEOUT"),
+		// Optional: The most targets a single sync may deregister from one target group.  The rest of a larger removal is
+		// held and logged, and later syncs remove up to this many at a time, since a large removal is more likely a DNS
+		// outage than real hosts going away
+		MaxRemovalCount: os.Getenv("MAX_REMOVAL_COUNT"),
+		// Optional: Like MAX_REMOVAL_COUNT, but as a percent of the target group's current targets
+		MaxRemovalPercent: os.Getenv("MAX_REMOVAL_PERCENT"),
+		// Optional: How many registered targets an empty DNS answer can never remove from a target group.  Tagged
+		// target groups can override it with a <TG_FROM_TAG_KEY>/min-targets tag
+		MinTargets: os.Getenv("MIN_TARGETS"),
+		// If true, daemon replicas elect a leader with a lease in DYNAMODB_TABLE and only the leader syncs
+		LeaderElection: os.Getenv("LEADER_ELECTION"),
+		// How long a leader's lease lasts.  A standby takes over within about this long after the leader dies.  Defaults to 30s
+		LeaderLeaseDuration: os.Getenv("LEADER_LEASE_DURATION"),
+		// Unique name of this replica for leader election.  Defaults to the hostname
+		LeaderIdentity: os.Getenv("LEADER_IDENTITY"),
+		// Optional: Append an audit event, as a line of JSON, to this file for every target registered or deregistered
+		AuditLogFile: os.Getenv("AUDIT_LOG_FILE"),
+		// If true, write audit events to stdout as lines of JSON
+		AuditLogStdout: os.Getenv("AUDIT_LOG_STDOUT"),
+		// Optional: Append audit events to this DynamoDB table.  It needs the string partition key TargetGroupARN and the
+		// string sort key EventID
+		AuditDynamoDBTable: os.Getenv("AUDIT_DYNAMODB_TABLE"),
+		// Optional: POST a JSON notification here when a sync changes target groups, or a target group keeps failing
+		NotifyWebhookURL: os.Getenv("NOTIFY_WEBHOOK_URL"),
+		// Optional: Sign NOTIFY_WEBHOOK_URL notifications with an HMAC-SHA256 of the body using this secret
+		NotifyWebhookSecret: os.Getenv("NOTIFY_WEBHOOK_SECRET"),
+		// Optional: Post notifications to this Slack compatible incoming webhook
+		NotifySlackWebhookURL: os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"),
+		// Optional: Publish notifications to this SNS topic
+		NotifySNSTopicARN: os.Getenv("NOTIFY_SNS_TOPIC_ARN"),
+		// The shortest time between notifications.  Changes in between are sent together.  Defaults to 1m
+		NotifyInterval: os.Getenv("NOTIFY_INTERVAL"),
+		// How many syncs in a row a target group must fail before notifying.  0 never notifies failures.  Defaults to 3
+		NotifyFailures: os.Getenv("NOTIFY_FAILURES"),
+		// If true, when a hostname's CNAME chain ends at a new canonical name, like a replaced load balancer, IPs missing
+		// from DNS are deregistered at once instead of after INVOCATIONS_BEFORE_DEREGISTRATION.  Only target groups with a
+		// single hostname are deregistered at once.
+		DeregisterOnCNAMEChange: os.Getenv("DEREGISTER_ON_CNAME_CHANGE"),
 	}.WithDefaults()
 }
 
@@ -144,6 +546,7 @@ func main() {
 
 type Service struct {
 	osExit       func(int)
+	args         []string
 	config       config
 	log          *zapctx.Logger
 	onListen     func(net.Listener)
@@ -155,10 +558,17 @@ type Service struct {
 	resolver     syncer.Resolver
 	syncer       *syncer.Syncer
 	session      *session.Session
+	registry     *prometheus.Registry
+	metrics      *metrics.Metrics
+	elector      *leader.Elector
+
+	// locationSessions are sessions for other accounts and regions, by location
+	locationSessions map[state.Location]*session.Session
 }
 
 var instance = Service{
 	osExit: os.Exit,
+	args:   os.Args[1:],
 	config: getConfig(),
 	tracers: &gotracing.Registry{
 		Constructors: map[string]gotracing.Constructor{
@@ -189,9 +599,13 @@ const (
 	lambdaRunningMode runningMode = iota
 	daemonRunningMode
 	oneTimeRunningMode
+	planRunningMode
 )
 
 func (m *Service) getRunningMode() runningMode {
+	if len(m.args) > 0 && m.args[0] == "plan" {
+		return planRunningMode
+	}
 	isLambdaMode, err := strconv.ParseBool(m.config.LambdaMode)
 	if err == nil && isLambdaMode {
 		return lambdaRunningMode
@@ -214,7 +628,7 @@ func (m *Service) Main() {
 			return
 		}
 	}
-	m.log.Info(context.Background(), "Starting", zap.Any("config", m.config))
+	m.log.Info(context.Background(), "Starting", zap.Object("config", m.config))
 	rootTracer, err := m.tracers.New(m.config.Tracer, gotracing.Config{
 		Log: m.log.With(zap.String("section", "setup_tracing")),
 		Env: os.Environ(),
@@ -233,6 +647,15 @@ func (m *Service) Main() {
 		return
 	}
 	m.logAWSUser(ctx)
+	if m.getRunningMode() == planRunningMode {
+		if err := m.runPlan(ctx, m.args[1:], os.Stdout); err != nil {
+			m.log.IfErr(err).Warn(ctx, "unable to run plan")
+			m.osExit(1)
+			return
+		}
+		m.osExit(0)
+		return
+	}
 	if m.getRunningMode() == oneTimeRunningMode {
 		err := m.runSingleSync(ctx)
 		if err != nil {
@@ -249,8 +672,32 @@ func (m *Service) Main() {
 		return
 	}
 
+	if fileFinder, ok := m.syncFinder.(*state.FileSyncFinder); ok {
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go fileFinder.Watch(watchCtx, configFileCheckInterval, reload)
+		defer func() {
+			signal.Stop(reload)
+			cancelWatch()
+		}()
+	}
+	if m.elector != nil {
+		electionCtx, cancelElection := context.WithCancel(ctx)
+		electionDone := make(chan struct{})
+		go func() {
+			defer close(electionDone)
+			m.elector.Run(electionCtx)
+		}()
+		defer func() {
+			cancelElection()
+			<-electionDone
+		}()
+	}
 	m.server = m.setupServer(cfg, m.log, rootTracer)
-	shutdownCallback, err := setupDebugServer(m.log, cfg.DebugListenAddr, m)
+	shutdownCallback, err := setupDebugServer(m.log, cfg.DebugListenAddr, m, map[string]http.Handler{
+		"/debug/resolvers": m.resolverStatusHandler(),
+	})
 	if err != nil {
 		m.log.IfErr(err).Panic(context.Background(), "unable to setup debug server")
 		m.osExit(1)
@@ -273,6 +720,12 @@ func (m *Service) Main() {
 
 func (m *Service) injection(ctx context.Context) error {
 	var err error
+	m.registry = prometheus.NewRegistry()
+	m.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m.metrics, err = metrics.New(m.registry)
+	if err != nil {
+		return fmt.Errorf("unable to register metrics: %w", err)
+	}
 	m.stateStorage, err = m.makeStateStorage(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to make state storage: %w", err)
@@ -282,7 +735,18 @@ func (m *Service) injection(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("unable to make sync finder: %w", err)
 	}
-	m.resolver = m.makeResolver(ctx)
+	serverOptions, err := m.makeServerOptions(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to make DNS server options: %w", err)
+	}
+	m.resolver, err = m.makeResolver(ctx, serverOptions)
+	if err != nil {
+		return fmt.Errorf("unable to make resolver: %w", err)
+	}
+	m.elector, err = m.makeElector(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to make leader elector: %w", err)
+	}
 	ses, err := m.getSession()
 	if err != nil {
 		return fmt.Errorf("unable to get aws session: %w", err)
@@ -292,11 +756,36 @@ func (m *Service) injection(ctx context.Context) error {
 		State:  m.stateStorage,
 		Client: elbv2.New(ses),
 		Config: syncer.Config{
-			InvocationsBeforeDeregistration: m.config.getInvocationsBeforeDeregistration(ctx, m.log),
-			RemoveUnknownTgIP:               m.config.getRemoveUnknownTgIP(ctx, m.log),
+			InvocationsBeforeDeregistration:          m.config.getInvocationsBeforeDeregistration(ctx, m.log),
+			RemoveUnknownTgIP:                        m.config.getRemoveUnknownTgIP(ctx, m.log),
+			UnhealthyInvocationsBeforeDeregistration: m.config.getUnhealthyInvocations(ctx, m.log),
+			DryRun:                                   m.getRunningMode() == planRunningMode || m.config.getDryRun(ctx, m.log),
+			Concurrency:                              m.config.getSyncConcurrency(ctx, m.log),
+			TargetGroupTimeout:                       m.config.getTargetGroupSyncTimeout(ctx, m.log),
+			MinRefreshInterval:                       m.config.getDNSMinRefreshInterval(ctx, m.log),
+			MaxRefreshInterval:                       m.config.getDNSMaxRefreshInterval(ctx, m.log),
+			MaxRemovalCount:                          m.config.getMaxRemovalCount(ctx, m.log),
+			MaxRemovalPercent:                        m.config.getMaxRemovalPercent(ctx, m.log),
+			MinTargets:                               m.config.getMinTargets(ctx, m.log),
+			FailuresBeforeNotification:               m.config.getNotifyFailures(ctx, m.log),
+			DeregisterOnCanonicalNameChange:          m.config.getDeregisterOnCNAMEChange(ctx, m.log),
 		},
 		Resolver:   m.resolver,
 		SyncFinder: m.syncFinder,
+		Metrics:    m.metrics,
+		Audit:      m.makeAuditSink(ctx, ses),
+		Notifier:   m.makeNotifier(ctx, ses),
+		NewClient: func(location state.Location) (elbv2iface.ELBV2API, error) {
+			locationSession, err := m.getLocationSession(location)
+			if err != nil {
+				return nil, err
+			}
+			return elbv2.New(locationSession), nil
+		},
+		ServerOptions: serverOptions,
+	}
+	if reporter, ok := m.syncFinder.(syncer.Reporter); ok {
+		m.syncer.Reporter = reporter
 	}
 	return nil
 }
@@ -313,9 +802,43 @@ func (m *Service) getSession() (*session.Session, error) {
 	return ses, nil
 }
 
+// getLocationSession returns a session for another account and region, assuming the location's role if it has one.
+// Not safe to call concurrently: the syncer only calls it while holding its own lock.
+func (m *Service) getLocationSession(location state.Location) (*session.Session, error) {
+	if existing, exists := m.locationSessions[location]; exists {
+		return existing, nil
+	}
+	ses, err := m.getSession()
+	if err != nil {
+		return nil, err
+	}
+	cfg := aws.NewConfig()
+	if location.Region != "" {
+		cfg = cfg.WithRegion(location.Region)
+	}
+	if location.RoleARN != "" {
+		// The credentials are refreshed before they expire
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(ses, location.RoleARN))
+	}
+	ret := ses.Copy(cfg)
+	if m.locationSessions == nil {
+		m.locationSessions = make(map[state.Location]*session.Session)
+	}
+	m.locationSessions[location] = ret
+	return ret, nil
+}
+
 func (m *Service) makeStateStorage(ctx context.Context) (state.Storage, error) {
+	if m.config.StateFile != "" {
+		logToUse := m.log.With(zap.String("class", "FileStorage"), zap.String("path", m.config.StateFile))
+		logToUse.Debug(ctx, "using file state storage")
+		return &state.FileStorage{
+			Path: m.config.StateFile,
+			Log:  logToUse,
+		}, nil
+	}
 	if m.config.DynamoDBTable == "" {
-		return nil, errors.New("expected env variable DYNAMODB_TABLE")
+		return nil, errors.New("expected env variable DYNAMODB_TABLE or STATE_FILE")
 	}
 	ses, err := m.getSession()
 	if err != nil {
@@ -328,21 +851,192 @@ func (m *Service) makeStateStorage(ctx context.Context) (state.Storage, error) {
 		Log:             logToUse,
 		Client:          dynamodb.New(ses),
 		SyncCachePrefix: m.config.TagCachePrefix,
+		Metrics:         m.metrics,
+	}, nil
+}
+
+func (m *Service) makeElector(ctx context.Context) (*leader.Elector, error) {
+	if m.getRunningMode() != daemonRunningMode {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(m.config.LeaderElection)
+	if err != nil || !enabled {
+		return nil, nil
+	}
+	if m.config.DynamoDBTable == "" {
+		return nil, errors.New("expected env variable DYNAMODB_TABLE for LEADER_ELECTION")
+	}
+	identity := m.config.LeaderIdentity
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get hostname for leader identity: %w", err)
+		}
+	}
+	ses, err := m.getSession()
+	if err != nil {
+		return nil, fmt.Errorf("unable to make aws session: %w", err)
+	}
+	leaseDuration := m.config.getLeaderLeaseDuration(ctx, m.log)
+	logToUse := m.log.With(zap.String("class", "Elector"), zap.String("identity", identity))
+	logToUse.Debug(ctx, "using leader election")
+	return &leader.Elector{
+		TableName:     m.config.DynamoDBTable,
+		Client:        dynamodb.New(ses),
+		Log:           logToUse,
+		LeaseKey:      "leader_" + m.config.TagCachePrefix,
+		Identity:      identity,
+		LeaseDuration: leaseDuration,
+		RenewInterval: leaseDuration / 3,
 	}, nil
 }
 
-func (m *Service) makeResolver(ctx context.Context) syncer.Resolver {
-	servers := strings.Split(m.config.DNSServers, ",")
+// makeBindingSyncFinder watches bindings for the life of the process.  They are already cached locally, so there is no
+// need for a sync cache.
+func (m *Service) makeBindingSyncFinder(ctx context.Context) (*kube.BindingSyncFinder, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load in cluster kubernetes config: %w", err)
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make kubernetes client: %w", err)
+	}
+	ret := &kube.BindingSyncFinder{
+		Client:    client,
+		Namespace: m.config.KubernetesBindingsNamespace,
+		Log:       m.log.With(zap.String("class", "binding_finder"), zap.String("namespace", m.config.KubernetesBindingsNamespace)),
+		Metrics:   m.metrics,
+		DryRun:    m.getRunningMode() == planRunningMode || m.config.getDryRun(ctx, m.log),
+	}
+	ret.Log.Debug(ctx, "using kubernetes binding sync finder")
+	if err := ret.Start(context.Background()); err != nil {
+		return nil, fmt.Errorf("unable to watch bindings: %w", err)
+	}
+	return ret, nil
+}
+
+func (m *Service) makeResolver(ctx context.Context, opts syncer.ServerOptions) (syncer.Resolver, error) {
+	var servers []string
+	for _, server := range strings.Split(m.config.DNSServers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
 	resolverLog := m.log.With(zap.String("servers", m.config.DNSServers))
 	resolverLog.Debug(ctx, "using multi DNS resolver")
-	return syncer.NewMultiResolver(resolverLog, servers)
+	ret, err := syncer.NewMultiResolver(resolverLog, servers, opts)
+	if err != nil {
+		return nil, err
+	}
+	ret.Metrics = m.metrics
+	return ret, nil
+}
+
+func (m *Service) makeServerOptions(ctx context.Context) (syncer.ServerOptions, error) {
+	ret := syncer.ServerOptions{
+		Quorum:                 m.config.getDNSQuorum(ctx, m.log),
+		Timeout:                m.config.getDNSTimeout(ctx, m.log),
+		FailuresBeforeCooldown: m.config.getDNSServerFailures(ctx, m.log),
+		Cooldown:               m.config.getDNSServerCooldown(ctx, m.log),
+	}
+	if m.config.DNSCABundle == "" {
+		return ret, nil
+	}
+	pem, err := os.ReadFile(m.config.DNSCABundle)
+	if err != nil {
+		return ret, fmt.Errorf("unable to read DNS_CA_BUNDLE: %w", err)
+	}
+	ret.RootCAs, err = x509.SystemCertPool()
+	if err != nil {
+		m.log.IfErr(err).Warn(ctx, "unable to load system certificates: only trusting DNS_CA_BUNDLE")
+		ret.RootCAs = x509.NewCertPool()
+	}
+	if !ret.RootCAs.AppendCertsFromPEM(pem) {
+		return ret, fmt.Errorf("no certificates found in DNS_CA_BUNDLE %s", m.config.DNSCABundle)
+	}
+	m.log.Debug(ctx, "trusting DNS CA bundle", zap.String("path", m.config.DNSCABundle))
+	return ret, nil
 }
 
+// makeAuditSink returns nil if no audit sink is configured
+func (m *Service) makeAuditSink(ctx context.Context, ses *session.Session) audit.Sink {
+	var sinks audit.MultiSink
+	if m.config.AuditLogFile != "" {
+		m.log.Debug(ctx, "writing audit events to file", zap.String("path", m.config.AuditLogFile))
+		sinks = append(sinks, &audit.FileSink{Path: m.config.AuditLogFile})
+	}
+	if m.config.getAuditLogStdout(ctx, m.log) {
+		m.log.Debug(ctx, "writing audit events to stdout")
+		sinks = append(sinks, &audit.WriterSink{Writer: os.Stdout})
+	}
+	if m.config.AuditDynamoDBTable != "" {
+		m.log.Debug(ctx, "writing audit events to dynamodb", zap.String("table_name", m.config.AuditDynamoDBTable))
+		sinks = append(sinks, &audit.DynamoDBSink{
+			TableName: m.config.AuditDynamoDBTable,
+			Client:    dynamodb.New(ses),
+			Metrics:   m.metrics,
+		})
+	}
+	switch len(sinks) {
+	case 0:
+		return nil
+	case 1:
+		return sinks[0]
+	default:
+		return sinks
+	}
+}
+
+// makeNotifier returns nil if no notifier is configured
+func (m *Service) makeNotifier(ctx context.Context, ses *session.Session) notify.Notifier {
+	var notifiers notify.Multi
+	if m.config.NotifyWebhookURL != "" {
+		m.log.Debug(ctx, "sending notifications to webhook")
+		notifiers = append(notifiers, &notify.Webhook{
+			URL:    m.config.NotifyWebhookURL,
+			Secret: m.config.NotifyWebhookSecret,
+			Client: &http.Client{Timeout: notifyTimeout},
+		})
+	}
+	if m.config.NotifySlackWebhookURL != "" {
+		m.log.Debug(ctx, "sending notifications to slack")
+		notifiers = append(notifiers, &notify.Slack{
+			URL:    m.config.NotifySlackWebhookURL,
+			Client: &http.Client{Timeout: notifyTimeout},
+		})
+	}
+	if m.config.NotifySNSTopicARN != "" {
+		m.log.Debug(ctx, "sending notifications to sns", zap.String("topic_arn", m.config.NotifySNSTopicARN))
+		notifiers = append(notifiers, &notify.SNS{
+			TopicARN: m.config.NotifySNSTopicARN,
+			Client:   sns.New(ses),
+		})
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return &notify.RateLimited{
+		Notifier: notifiers,
+		Interval: m.config.getNotifyInterval(ctx, m.log),
+		OnError: func(err error) {
+			m.log.IfErr(err).Warn(context.Background(), "unable to send held notification")
+		},
+	}
+}
+
+// notifyTimeout bounds how long posting a notification can take
+const notifyTimeout = time.Second * 10
+
 func (m *Service) makeSyncCache(ctx context.Context) state.SyncCache {
 	if m.getRunningMode() == daemonRunningMode {
 		m.log.Debug(ctx, "using local sync cache b/c of daemon mode")
 		return &state.LocalSyncCache{}
 	}
+	if m.getRunningMode() == planRunningMode || m.config.getDryRun(ctx, m.log) {
+		m.log.Debug(ctx, "using local sync cache b/c nothing should be written in a dry run")
+		return &state.LocalSyncCache{}
+	}
 	if asSyncCache, ok := m.stateStorage.(state.SyncCache); ok {
 		m.log.Debug(ctx, "using remove storage as sync cache")
 		return asSyncCache
@@ -352,6 +1046,21 @@ func (m *Service) makeSyncCache(ctx context.Context) state.SyncCache {
 }
 
 func (m *Service) makeSyncFinder(ctx context.Context) (state.SyncFinder, error) {
+	if m.config.getKubernetesBindings(ctx, m.log) {
+		return m.makeBindingSyncFinder(ctx)
+	}
+	if m.config.ConfigFile != "" {
+		fileFinder := &state.FileSyncFinder{
+			Path:    m.config.ConfigFile,
+			Log:     m.log.With(zap.String("class", "file_finder")),
+			Metrics: m.metrics,
+		}
+		m.log.Debug(ctx, "using config file sync finder")
+		if err := fileFinder.Load(ctx); err != nil {
+			return nil, err
+		}
+		return fileFinder, nil
+	}
 	if m.config.TgFromTagKey == "" {
 		if m.config.ElbTgArn == "" {
 			return nil, fmt.Errorf("expect ELB_TG_ARN or TG_FROM_TAG_KEY set")
@@ -359,10 +1068,21 @@ func (m *Service) makeSyncFinder(ctx context.Context) (state.SyncFinder, error)
 		if m.config.TargetFqdn == "" {
 			return nil, fmt.Errorf("expect TARGET_FQDN or TG_FROM_TAG_KEY set")
 		}
+		mapping := state.Mapping{
+			Hostnames:        state.ParseHostnames(m.config.TargetFqdn),
+			AvailabilityZone: m.config.TargetAvailabilityZone,
+		}
+		if m.config.TargetPort != "" {
+			port, err := strconv.ParseInt(m.config.TargetPort, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse TARGET_PORT: %w", err)
+			}
+			mapping.Port = port
+		}
 		m.log.Debug(ctx, "making hard coded sync finder")
 		return &state.HardCodedSyncFinder{
 			TargetGroupARN: state.TargetGroupARN(m.config.ElbTgArn),
-			Hostname:       m.config.TargetFqdn,
+			Mapping:        mapping,
 		}, nil
 	}
 	ses, err := m.getSession()
@@ -372,9 +1092,25 @@ func (m *Service) makeSyncFinder(ctx context.Context) (state.SyncFinder, error)
 	syncFinderLogger := m.log.With(zap.String("tag_key", m.config.TgFromTagKey))
 	syncFinderLogger.Debug(ctx, "using tag searching sync finder")
 	tagFinder := &state.TagSyncFinder{
-		Client: resourcegroupstaggingapi.New(ses),
-		TagKey: m.config.TgFromTagKey,
-		Log:    syncFinderLogger,
+		Client:  resourcegroupstaggingapi.New(ses),
+		TagKey:  m.config.TgFromTagKey,
+		Log:     syncFinderLogger,
+		Metrics: m.metrics,
+	}
+	locations, err := state.ParseLocations(m.config.TagSearchLocations)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse TAG_SEARCH_LOCATIONS: %w", err)
+	}
+	for _, location := range locations {
+		locationSession, err := m.getLocationSession(location)
+		if err != nil {
+			return nil, fmt.Errorf("unable to make aws session for %s: %w", location, err)
+		}
+		if tagFinder.Locations == nil {
+			tagFinder.Locations = make(map[state.Location]resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI)
+		}
+		tagFinder.Locations[location] = resourcegroupstaggingapi.New(locationSession)
+		syncFinderLogger.Debug(ctx, "also searching location", zap.Stringer("location", location))
 	}
 	if m.syncCache == nil {
 		return tagFinder, nil
@@ -397,15 +1133,31 @@ func (m *Service) runSingleSync(ctx context.Context) error {
 	return nil
 }
 
+func (m *Service) runDueSync(ctx context.Context) error {
+	m.log.Debug(ctx, "<- runDueSync")
+	defer m.log.Debug(ctx, "-> runDueSync")
+	err := m.syncer.SyncDue(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to run due sync: %w", err)
+	}
+	return nil
+}
+
 func (m *Service) runLambda() {
 	lambda.Start(m.runSingleSync)
 }
 
 func (m *Service) setupServer(cfg config, log *zapctx.Logger, tracer gotracing.Tracing) *http.Server {
 	rootHandler := mux.NewRouter()
-	rootHandler.Handle("/health", httpsimple.HealthHandler(log, tracer))
+	rootHandler.Handle("/health", m.healthHandler(log, tracer))
 	triggerHandler := httpsimple.BasicHandler(func(request *http.Request) httpsimple.CanHTTPWrite {
 		var ret httpsimple.BasicResponse
+		if m.elector != nil && !m.elector.IsLeader() {
+			// Only the leader may sync, or standbys would fight it over the target groups
+			ret.Code = http.StatusServiceUnavailable
+			ret.Msg = strings.NewReader("standby: not syncing")
+			return &ret
+		}
 		if err := m.runSingleSync(request.Context()); err != nil {
 			ret.Code = 503
 			ret.Msg = strings.NewReader(err.Error())
@@ -416,17 +1168,60 @@ func (m *Service) setupServer(cfg config, log *zapctx.Logger, tracer gotracing.T
 		return &ret
 	}, m.log)
 	rootHandler.Handle("/trigger", triggerHandler)
+	rootHandler.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
 	return &http.Server{
 		Addr:    cfg.ListenAddr,
 		Handler: rootHandler,
 	}
 }
 
+// healthHandler always reports healthy, so standbys stay running.  With leader election it also reports whether this
+// replica is the leader.
+func (m *Service) healthHandler(log *zapctx.Logger, tracer gotracing.Tracing) http.Handler {
+	if m.elector == nil {
+		return httpsimple.HealthHandler(log, tracer)
+	}
+	return httpsimple.BasicHandler(func(request *http.Request) httpsimple.CanHTTPWrite {
+		status := m.elector.Status()
+		msg := fmt.Sprintf("OK standby (leader: %s)", status.Leader)
+		if status.IsLeader {
+			msg = "OK leader"
+		}
+		return &httpsimple.BasicResponse{
+			Code: 200,
+			Msg:  strings.NewReader(msg),
+		}
+	}, log)
+}
+
+// resolverStatusHandler reports the health of every DNS server as JSON
+func (m *Service) resolverStatusHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(m.syncer.ResolverStatus()); err != nil {
+			m.log.IfErr(err).Warn(req.Context(), "unable to write resolver status")
+		}
+	})
+}
+
+// configFileCheckInterval is how often daemon mode checks CONFIG_FILE for changes
+const configFileCheckInterval = time.Second * 10
+
+// ttlSchedulingTickInterval is how often DNS_TTL_SCHEDULING checks for target groups that are due
+const ttlSchedulingTickInterval = time.Second
+
 func (m *Service) setupTicker() (func(), error) {
 	tickInterval, err := time.ParseDuration(m.config.DNSRefreshInterval)
 	if err != nil {
 		return nil, err
 	}
+	syncFunc := m.runSingleSync
+	if m.config.getDNSTTLScheduling(context.Background(), m.log) {
+		tickInterval = ttlSchedulingTickInterval
+		syncFunc = m.runDueSync
+	}
 	onClose := make(chan struct{})
 	ticker := time.NewTicker(tickInterval)
 	go func() {
@@ -436,7 +1231,11 @@ func (m *Service) setupTicker() (func(), error) {
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				if err := m.runSingleSync(context.Background()); err != nil {
+				if m.elector != nil && !m.elector.IsLeader() {
+					m.log.Debug(context.Background(), "standby: skipping sync")
+					continue
+				}
+				if err := syncFunc(context.Background()); err != nil {
 					m.log.IfErr(err).Warn(context.Background(), "unable to run single sync")
 				}
 			}
@@ -460,7 +1259,7 @@ func (m *Service) logAWSUser(ctx context.Context) {
 	m.log.Info(ctx, "using aws session", zap.String("account", *res.Account), zap.String("user_id", *res.UserId), zap.String("arn", *res.Arn))
 }
 
-func setupDebugServer(l *zapctx.Logger, listenAddr string, obj interface{}) (func(), error) {
+func setupDebugServer(l *zapctx.Logger, listenAddr string, obj interface{}, handlers map[string]http.Handler) (func(), error) {
 	if listenAddr == "" || listenAddr == "-" {
 		return func() {
 		}, nil
@@ -469,6 +1268,9 @@ func setupDebugServer(l *zapctx.Logger, listenAddr string, obj interface{}) (fun
 		Logger:        &zapctx.FieldLogger{Logger: l},
 		ExplorableObj: obj,
 	})
+	for path, handler := range handlers {
+		ret.Mux.Handle(path, handler)
+	}
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to listen to %s: %w", listenAddr, err)
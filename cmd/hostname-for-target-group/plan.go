@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/cresta/hostname-for-target-group/internal/syncer"
+)
+
+// runPlan prints the changes a sync would make, without changing any target group or stored state
+func (m *Service) runPlan(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	fs.SetOutput(out)
+	output := fs.String("output", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("unable to parse plan flags: %w", err)
+	}
+	plans, err := m.syncer.Plan(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to plan sync: %w", err)
+	}
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	case "text":
+		return writePlansText(out, plans)
+	default:
+		return fmt.Errorf("unknown plan output %s", *output)
+	}
+}
+
+func writePlansText(out io.Writer, plans []syncer.Plan) error {
+	for _, p := range plans {
+		if _, err := fmt.Fprintf(out, "%s %v\n", p.TargetGroupARN, p.Hostnames); err != nil {
+			return err
+		}
+		lines := make([]string, 0, len(p.ToAdd)+len(p.ToRemove)+len(p.HeldRemovals)+len(p.NewState.Targets))
+		if p.Error != "" {
+			lines = append(lines, "  ! "+p.Error)
+		}
+		for _, c := range p.CanonicalNameChanges {
+			lines = append(lines, fmt.Sprintf("  > %s CNAME target changed: %s -> %s", c.Hostname, c.Previous, c.Current))
+		}
+		for _, ip := range p.ToAdd {
+			lines = append(lines, "  + "+ip)
+		}
+		for _, ip := range p.ToRemove {
+			lines = append(lines, "  - "+ip)
+		}
+		for _, ip := range p.HeldRemovals {
+			lines = append(lines, "  = "+ip+" held: "+p.HoldReason)
+		}
+		for _, t := range p.NewState.Targets {
+			if t.TimesMissing > 0 {
+				lines = append(lines, fmt.Sprintf("  ~ %s missing %d/%d", syncer.TargetKey(t.IP, t.Port), t.TimesMissing, p.InvocationsBeforeDeregistration))
+			}
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "  no changes")
+		}
+		for _, line := range lines {
+			if _, err := fmt.Fprintln(out, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
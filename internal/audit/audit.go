@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+)
+
+const (
+	ActionRegister   = "register"
+	ActionDeregister = "deregister"
+)
+
+// Event records targets registered with or deregistered from a target group for the same reason
+type Event struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	TargetGroupARN string    `json:"targetGroupARN"`
+	// Hostnames synced into the target group
+	Hostnames []string `json:"hostnames"`
+	// Targets are the IPs changed, or IP:port if the mapping has a port or SRV hostnames
+	Targets []string `json:"targets"`
+	// Reason is why the targets changed, like "new in DNS", "missed 3 times", or "unknown"
+	Reason string `json:"reason"`
+	// Resolvers are the DNS servers that answered for Hostnames
+	Resolvers []string `json:"resolvers,omitempty"`
+	// CNAMEChains are the CNAME targets followed from each hostname that is a CNAME, by hostname
+	CNAMEChains map[string][]string `json:"cnameChains,omitempty"`
+	// StateVersion is the version of the target group's state stored by the sync
+	StateVersion int `json:"stateVersion"`
+}
+
+// Sink records audit events
+type Sink interface {
+	Record(ctx context.Context, events []Event) error
+}
+
+// WriterSink writes each event as a line of JSON
+type WriterSink struct {
+	Writer io.Writer
+	mu     sync.Mutex
+}
+
+func (w *WriterSink) Record(_ context.Context, events []Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return writeEvents(w.Writer, events)
+}
+
+func writeEvents(w io.Writer, events []Event) error {
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("unable to write audit event: %w", err)
+		}
+	}
+	return nil
+}
+
+var _ Sink = &WriterSink{}
+
+// FileSink appends each event as a line of JSON to a file.  The file is opened for every write, so it can be rotated.
+type FileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *FileSink) Record(_ context.Context, events []Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log %s: %w", f.Path, err)
+	}
+	if err := writeEvents(file, events); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+var _ Sink = &FileSink{}
+
+// DynamoDBSink appends events to a history table with the string partition key TargetGroupARN and the string sort key
+// EventID.  Events are never overwritten.
+type DynamoDBSink struct {
+	TableName string
+	Client    *dynamodb.DynamoDB
+	// Metrics is optional and records request latency
+	Metrics *metrics.Metrics
+}
+
+type historyObject struct {
+	TargetGroupARN string
+	// EventID sorts events by time
+	EventID      string
+	Time         string
+	Action       string
+	Hostnames    []string
+	Targets      []string
+	Reason       string
+	Resolvers    []string
+	CNAMEChains  map[string][]string
+	StateVersion int
+}
+
+// eventIDFormat has a fixed width, unlike time.RFC3339Nano, so IDs sort by time
+const eventIDFormat = "2006-01-02T15:04:05.000000000Z"
+
+func (d *DynamoDBSink) Record(ctx context.Context, events []Event) error {
+	for _, e := range events {
+		encoded, err := dynamodbattribute.MarshalMap(historyObject{
+			TargetGroupARN: e.TargetGroupARN,
+			EventID:        e.Time.UTC().Format(eventIDFormat) + " " + e.Action + " " + e.Reason,
+			Time:           e.Time.UTC().Format(time.RFC3339Nano),
+			Action:         e.Action,
+			Hostnames:      e.Hostnames,
+			Targets:        e.Targets,
+			Reason:         e.Reason,
+			Resolvers:      e.Resolvers,
+			CNAMEChains:    e.CNAMEChains,
+			StateVersion:   e.StateVersion,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to marshal audit event: %w", err)
+		}
+		start := time.Now()
+		_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:           &d.TableName,
+			Item:                encoded,
+			ConditionExpression: aws.String("attribute_not_exists(TargetGroupARN)"),
+		})
+		d.Metrics.ObserveDynamoDB("PutItem", start)
+		if err != nil {
+			return fmt.Errorf("unable to store audit event: %w", err)
+		}
+	}
+	return nil
+}
+
+var _ Sink = &DynamoDBSink{}
+
+// MultiSink records events to every sink, even if some fail
+type MultiSink []Sink
+
+func (m MultiSink) Record(ctx context.Context, events []Event) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.Record(ctx, events); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+var _ Sink = MultiSink{}
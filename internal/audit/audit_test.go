@@ -0,0 +1,131 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/cresta/hostname-for-target-group/internal/audit"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvents() []audit.Event {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	return []audit.Event{
+		{
+			Time:           now,
+			Action:         audit.ActionRegister,
+			TargetGroupARN: "arn:test",
+			Hostnames:      []string{"a.example.com"},
+			Targets:        []string{"1.2.3.4"},
+			Reason:         "new in DNS",
+			Resolvers:      []string{"10.0.0.2:53"},
+			CNAMEChains:    map[string][]string{"a.example.com": {"lb.example.com"}},
+			StateVersion:   3,
+		},
+		{
+			Time:           now,
+			Action:         audit.ActionDeregister,
+			TargetGroupARN: "arn:test",
+			Hostnames:      []string{"a.example.com"},
+			Targets:        []string{"1.2.3.5"},
+			Reason:         "missed 3 times",
+			StateVersion:   3,
+		},
+	}
+}
+
+func readEvents(t *testing.T, b []byte) []audit.Event {
+	var ret []audit.Event
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var e audit.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		ret = append(ret, e)
+	}
+	require.NoError(t, scanner.Err())
+	return ret
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &audit.WriterSink{Writer: &buf}
+	require.NoError(t, sink.Record(context.Background(), testEvents()))
+	require.Equal(t, testEvents(), readEvents(t, buf.Bytes()))
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink := &audit.FileSink{Path: path}
+	require.NoError(t, sink.Record(context.Background(), testEvents()[:1]))
+	require.NoError(t, sink.Record(context.Background(), testEvents()[1:]))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, testEvents(), readEvents(t, b), "events are appended")
+
+	sink = &audit.FileSink{Path: filepath.Join(t.TempDir(), "missing", "audit.jsonl")}
+	require.Error(t, sink.Record(context.Background(), testEvents()))
+}
+
+func TestDynamoDBSink(t *testing.T) {
+	var mu sync.Mutex
+	var puts []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var in map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		puts = append(puts, in)
+		mu.Unlock()
+		rw.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	ses, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	require.NoError(t, err)
+	sink := &audit.DynamoDBSink{
+		TableName: "history",
+		Client:    dynamodb.New(ses),
+	}
+	require.NoError(t, sink.Record(context.Background(), testEvents()))
+	require.Len(t, puts, 2)
+	require.Equal(t, "history", puts[0]["TableName"])
+	require.Equal(t, "attribute_not_exists(TargetGroupARN)", puts[0]["ConditionExpression"], "history is append only")
+	item := puts[0]["Item"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"S": "arn:test"}, item["TargetGroupARN"])
+	require.Equal(t, map[string]interface{}{"S": "2023-03-01T12:00:00.000000000Z register new in DNS"}, item["EventID"])
+	require.Equal(t, map[string]interface{}{"N": "3"}, item["StateVersion"])
+}
+
+type failingSink struct{}
+
+func (failingSink) Record(context.Context, []audit.Event) error {
+	return errors.New("unable to record")
+}
+
+func TestMultiSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := audit.MultiSink{failingSink{}, &audit.WriterSink{Writer: &buf}}
+	require.Error(t, sink.Record(context.Background(), testEvents()))
+	require.Equal(t, testEvents(), readEvents(t, buf.Bytes()), "later sinks still record")
+}
@@ -0,0 +1,274 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/hostname-for-target-group/internal/syncer"
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// BindingResource is the TargetGroupHostnameBinding custom resource.  The CRD is installed by the helm chart.
+var BindingResource = schema.GroupVersionResource{
+	Group:    "cresta.ai",
+	Version:  "v1alpha1",
+	Resource: "targetgrouphostnamebindings",
+}
+
+// TargetGroupHostnameBinding binds a target group to the hostnames whose IPs it should contain
+type TargetGroupHostnameBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              BindingSpec   `json:"spec"`
+	Status            BindingStatus `json:"status,omitempty"`
+}
+
+type BindingSpec struct {
+	TargetGroupARN string   `json:"targetGroupARN"`
+	Hostnames      []string `json:"hostnames"`
+	// Port to register targets with.  Zero uses the target group's default port.
+	Port int64 `json:"port,omitempty"`
+	// AvailabilityZone to register targets with.  Use "all" for IPs outside the VPC.
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	// InvocationsBeforeDeregistration overrides INVOCATIONS_BEFORE_DEREGISTRATION
+	InvocationsBeforeDeregistration *int `json:"invocationsBeforeDeregistration,omitempty"`
+	// RemoveUnknownTgIP overrides REMOVE_UNKNOWN_TG_IP
+	RemoveUnknownTgIP *bool `json:"removeUnknownTgIP,omitempty"`
+	// MinTargets overrides MIN_TARGETS
+	MinTargets *int `json:"minTargets,omitempty"`
+}
+
+type BindingStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastSyncTime is when the status was last written.  A status that has not changed is only written again every
+	// statusRefreshInterval, so every sync does not write to the API server.
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// RegisteredTargets are the targets in the target group after the last successful sync
+	RegisteredTargets []string `json:"registeredTargets,omitempty"`
+	// Error is why the last sync failed.  Empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+func (b *TargetGroupHostnameBinding) mapping() (state.Mapping, error) {
+	if b.Spec.TargetGroupARN == "" {
+		return state.Mapping{}, fmt.Errorf("no targetGroupARN")
+	}
+	ret := state.Mapping{
+		Hostnames:                       state.ParseHostnames(strings.Join(b.Spec.Hostnames, ",")),
+		Port:                            b.Spec.Port,
+		AvailabilityZone:                b.Spec.AvailabilityZone,
+		InvocationsBeforeDeregistration: b.Spec.InvocationsBeforeDeregistration,
+		RemoveUnknownTgIP:               b.Spec.RemoveUnknownTgIP,
+		MinTargets:                      b.Spec.MinTargets,
+	}
+	if len(ret.Hostnames) == 0 {
+		return state.Mapping{}, fmt.Errorf("no hostnames")
+	}
+	if ret.Port < 0 || ret.Port > 65535 {
+		return state.Mapping{}, fmt.Errorf("invalid port %d", ret.Port)
+	}
+	return ret, nil
+}
+
+// BindingSyncFinder syncs the target groups of every TargetGroupHostnameBinding, and writes the result of each sync to
+// the binding's status.  Call Start before ToSync.
+type BindingSyncFinder struct {
+	Client dynamic.Interface
+	// Namespace to watch.  Empty watches every namespace.
+	Namespace string
+	Log       *zapctx.Logger
+	// Metrics is optional and records how many target groups were found
+	Metrics *metrics.Metrics
+	// DryRun never writes binding status
+	DryRun bool
+
+	lister cache.GenericLister
+	// owners is the binding each target group was last synced from
+	owners map[state.TargetGroupARN]*TargetGroupHostnameBinding
+	// now defaults to time.Now
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// Start watches bindings until ctx is done, and waits for the first list to finish
+func (b *BindingSyncFinder) Start(ctx context.Context) error {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(b.Client, 0, b.Namespace, nil)
+	b.lister = factory.ForResource(BindingResource).Lister()
+	factory.Start(ctx.Done())
+	for gvr, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("unable to list %s", gvr.Resource)
+		}
+	}
+	return nil
+}
+
+func (b *BindingSyncFinder) ToSync(ctx context.Context) (map[state.TargetGroupARN]state.Mapping, error) {
+	b.Log.Debug(ctx, "<- ToSync")
+	defer b.Log.Debug(ctx, "-> ToSync")
+	if b.lister == nil {
+		return nil, fmt.Errorf("binding sync finder not started")
+	}
+	objs, err := b.lister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list bindings: %w", err)
+	}
+	bindings := make([]*TargetGroupHostnameBinding, 0, len(objs))
+	for _, obj := range objs {
+		binding, err := fromObject(obj)
+		if err != nil {
+			b.Log.IfErr(err).Warn(ctx, "unable to decode binding: skipping")
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	// Oldest binding wins if more than one binds the same target group, so the winner does not change as others come
+	// and go
+	sort.Slice(bindings, func(i, j int) bool {
+		if !bindings[i].CreationTimestamp.Equal(&bindings[j].CreationTimestamp) {
+			return bindings[i].CreationTimestamp.Before(&bindings[j].CreationTimestamp)
+		}
+		return bindingName(bindings[i]) < bindingName(bindings[j])
+	})
+	ret := make(map[state.TargetGroupARN]state.Mapping, len(bindings))
+	owners := make(map[state.TargetGroupARN]*TargetGroupHostnameBinding, len(bindings))
+	for _, binding := range bindings {
+		mapping, err := binding.mapping()
+		if err != nil {
+			b.Log.IfErr(err).Warn(ctx, "invalid binding: skipping", zap.String("binding", bindingName(binding)))
+			b.writeStatus(ctx, binding, nil, fmt.Errorf("invalid binding: %w", err))
+			continue
+		}
+		tgArn := state.TargetGroupARN(binding.Spec.TargetGroupARN)
+		if owner, exists := owners[tgArn]; exists {
+			b.Log.Warn(ctx, "target group bound more than once: skipping", zap.String("binding", bindingName(binding)), zap.String("owner", bindingName(owner)))
+			b.writeStatus(ctx, binding, nil, fmt.Errorf("target group is already bound by %s", bindingName(owner)))
+			continue
+		}
+		ret[tgArn] = mapping
+		owners[tgArn] = binding
+	}
+	b.mu.Lock()
+	b.owners = owners
+	b.mu.Unlock()
+	b.Log.Debug(ctx, "found arn to sync", zap.Any("arn", ret))
+	b.Metrics.TagFinderResults(len(ret))
+	return ret, nil
+}
+
+// ReportSync writes the result of syncing a target group to the status of its binding
+func (b *BindingSyncFinder) ReportSync(ctx context.Context, targetGroupARN state.TargetGroupARN, plan *syncer.Plan, err error) {
+	b.mu.Lock()
+	binding, exists := b.owners[targetGroupARN]
+	b.mu.Unlock()
+	if !exists {
+		return
+	}
+	b.writeStatus(ctx, binding, plan, err)
+}
+
+// statusRefreshInterval is how often a binding status that has not changed is written anyway, so lastSyncTime shows
+// syncs are still running
+const statusRefreshInterval = time.Minute * 5
+
+// statusCurrent returns true if the binding's status already says what a new status would, and was written recently
+func statusCurrent(binding *TargetGroupHostnameBinding, registered []string, syncErr error, now time.Time) bool {
+	current := binding.Status
+	if current.ObservedGeneration != binding.Generation || current.LastSyncTime == nil || now.Sub(current.LastSyncTime.Time) >= statusRefreshInterval {
+		return false
+	}
+	if syncErr != nil {
+		return current.Error == syncErr.Error()
+	}
+	if current.Error != "" || len(current.RegisteredTargets) != len(registered) {
+		return false
+	}
+	for i := range registered {
+		if current.RegisteredTargets[i] != registered[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeStatus writes the result of a sync, or why a binding is not synced, unless the status already says so
+func (b *BindingSyncFinder) writeStatus(ctx context.Context, binding *TargetGroupHostnameBinding, plan *syncer.Plan, syncErr error) {
+	if b.DryRun {
+		return
+	}
+	var registered []string
+	if syncErr == nil {
+		registered = plan.Registered()
+	}
+	now := b.currentTime()
+	if statusCurrent(binding, registered, syncErr, now) {
+		return
+	}
+	lastSyncTime := metav1.NewTime(now)
+	status := map[string]interface{}{
+		"observedGeneration": binding.Generation,
+		"lastSyncTime":       lastSyncTime,
+	}
+	if syncErr != nil {
+		status["error"] = syncErr.Error()
+	} else {
+		// null removes the error left by an earlier sync
+		status["error"] = nil
+		status["registeredTargets"] = registered
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": status,
+	})
+	if err != nil {
+		b.Log.IfErr(err).Warn(ctx, "unable to encode binding status")
+		return
+	}
+	_, err = b.Client.Resource(BindingResource).Namespace(binding.Namespace).Patch(ctx, binding.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		b.Log.IfErr(err).Warn(ctx, "unable to write binding status", zap.String("binding", bindingName(binding)))
+	}
+}
+
+func (b *BindingSyncFinder) currentTime() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func fromObject(obj runtime.Object) (*TargetGroupHostnameBinding, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	var ret TargetGroupHostnameBinding
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &ret); err != nil {
+		return nil, fmt.Errorf("unable to convert %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+	}
+	return &ret, nil
+}
+
+func bindingName(b *TargetGroupHostnameBinding) string {
+	return b.Namespace + "/" + b.Name
+}
+
+var _ state.SyncFinder = &BindingSyncFinder{}
+
+var _ syncer.Reporter = &BindingSyncFinder{}
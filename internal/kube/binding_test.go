@@ -0,0 +1,229 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/hostname-for-target-group/internal/syncer"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newBinding(t *testing.T, name string, created time.Time, spec BindingSpec) *unstructured.Unstructured {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&TargetGroupHostnameBinding{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: BindingResource.GroupVersion().String(),
+			Kind:       "TargetGroupHostnameBinding",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Generation:        1,
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: spec,
+	})
+	require.NoError(t, err)
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func TestBindingSyncFinder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	now := time.Now().Truncate(time.Second)
+	three := 3
+	no := false
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		BindingResource: "TargetGroupHostnameBindingList",
+	},
+		newBinding(t, "web", now, BindingSpec{
+			TargetGroupARN:                  "arn:web",
+			Hostnames:                       []string{"b.example.com", "a.example.com"},
+			Port:                            8443,
+			InvocationsBeforeDeregistration: &three,
+			RemoveUnknownTgIP:               &no,
+		}),
+		newBinding(t, "web-copy", now.Add(time.Minute), BindingSpec{
+			TargetGroupARN: "arn:web",
+			Hostnames:      []string{"c.example.com"},
+		}),
+		newBinding(t, "empty", now, BindingSpec{
+			TargetGroupARN: "arn:empty",
+		}),
+	)
+	finder := &BindingSyncFinder{
+		Client: client,
+		Log:    testhelp.ZapTestingLogger(t),
+	}
+	require.NoError(t, finder.Start(ctx))
+	toSync, err := finder.ToSync(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[state.TargetGroupARN]state.Mapping{
+		"arn:web": {
+			Hostnames:                       []string{"a.example.com", "b.example.com"},
+			Port:                            8443,
+			InvocationsBeforeDeregistration: &three,
+			RemoveUnknownTgIP:               &no,
+		},
+	}, toSync)
+	require.Equal(t, "target group is already bound by default/web", getStatus(ctx, t, finder, "web-copy").Error)
+	require.Equal(t, "invalid binding: no hostnames", getStatus(ctx, t, finder, "empty").Error)
+
+	finder.ReportSync(ctx, "arn:web", nil, errors.New("unable to resolve"))
+	status := getStatus(ctx, t, finder, "web")
+	require.Equal(t, "unable to resolve", status.Error)
+	require.NotNil(t, status.LastSyncTime)
+	require.Equal(t, int64(1), status.ObservedGeneration)
+
+	// A successful sync clears the error
+	elb := &fakeELB{}
+	s := &syncer.Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: elb,
+		State:  &state.FileStorage{Path: t.TempDir() + "/state.json", Log: testhelp.ZapTestingLogger(t)},
+		Resolver: staticResolver{
+			"a.example.com": {{IP: []byte{1, 2, 3, 4}}},
+			"b.example.com": {{IP: []byte{1, 2, 3, 5}}},
+		},
+		SyncFinder: finder,
+		Reporter:   finder,
+	}
+	require.NoError(t, s.Sync(ctx))
+	status = getStatus(ctx, t, finder, "web")
+	require.Empty(t, status.Error)
+	require.Equal(t, []string{"1.2.3.4:8443", "1.2.3.5:8443"}, status.RegisteredTargets)
+	require.Len(t, elb.registered, 2)
+	require.Equal(t, aws.Int64(8443), elb.registered[0].Port)
+}
+
+func TestBindingSyncFinderDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		BindingResource: "TargetGroupHostnameBindingList",
+	}, newBinding(t, "empty", time.Now(), BindingSpec{TargetGroupARN: "arn:empty"}))
+	finder := &BindingSyncFinder{
+		Client: client,
+		Log:    testhelp.ZapTestingLogger(t),
+		DryRun: true,
+	}
+	require.NoError(t, finder.Start(ctx))
+	toSync, err := finder.ToSync(ctx)
+	require.NoError(t, err)
+	require.Empty(t, toSync)
+	require.Empty(t, getStatus(ctx, t, finder, "empty").Error)
+}
+
+func TestBindingSyncFinderStatusWrites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		BindingResource: "TargetGroupHostnameBindingList",
+	}, newBinding(t, "web", time.Now(), BindingSpec{TargetGroupARN: "arn:web", Hostnames: []string{"a.example.com"}}))
+	now := time.Now().Truncate(time.Second)
+	finder := &BindingSyncFinder{
+		Client: client,
+		Log:    testhelp.ZapTestingLogger(t),
+		now: func() time.Time {
+			return now
+		},
+	}
+	require.NoError(t, finder.Start(ctx))
+	patches := func() int {
+		ret := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "patch" && action.GetSubresource() == "status" {
+				ret++
+			}
+		}
+		return ret
+	}
+	report := func(plan *syncer.Plan, err error) {
+		_, toSyncErr := finder.ToSync(ctx)
+		require.NoError(t, toSyncErr)
+		finder.ReportSync(ctx, "arn:web", plan, err)
+		// Wait for the informer to see any write, like the next sync would
+		want := getStatus(ctx, t, finder, "web")
+		require.Eventually(t, func() bool {
+			obj, err := finder.lister.ByNamespace("default").Get("web")
+			require.NoError(t, err)
+			listed, err := fromObject(obj)
+			require.NoError(t, err)
+			return listed.Status.LastSyncTime.Equal(want.LastSyncTime)
+		}, time.Second*5, time.Millisecond*10)
+	}
+
+	report(&syncer.Plan{ToAdd: []string{"1.2.3.4"}}, nil)
+	require.Equal(t, 1, patches())
+	now = now.Add(time.Second * 5)
+	report(&syncer.Plan{ToAdd: []string{"1.2.3.4"}}, nil)
+	require.Equal(t, 1, patches(), "an unchanged status is not written again")
+	report(&syncer.Plan{ToAdd: []string{"1.2.3.4", "1.2.3.5"}}, nil)
+	require.Equal(t, 2, patches())
+	report(nil, errors.New("unable to resolve"))
+	require.Equal(t, 3, patches())
+	report(nil, errors.New("unable to resolve"))
+	require.Equal(t, 3, patches())
+
+	now = now.Add(statusRefreshInterval)
+	report(nil, errors.New("unable to resolve"))
+	require.Equal(t, 4, patches(), "lastSyncTime is refreshed")
+	require.Equal(t, now, getStatus(ctx, t, finder, "web").LastSyncTime.Time)
+}
+
+func getStatus(ctx context.Context, t *testing.T, finder *BindingSyncFinder, name string) BindingStatus {
+	obj, err := finder.Client.Resource(BindingResource).Namespace("default").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	binding, err := fromObject(obj)
+	require.NoError(t, err)
+	return binding.Status
+}
+
+type staticResolver map[string][]net.IPAddr
+
+func (s staticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ret, exists := s[host]
+	if !exists {
+		return nil, errors.New("no such host")
+	}
+	return ret, nil
+}
+
+type fakeELB struct {
+	elbv2iface.ELBV2API
+	registered []*elbv2.TargetDescription
+	mu         sync.Mutex
+}
+
+func (f *fakeELB) DescribeTargetGroupsWithContext(_ aws.Context, in *elbv2.DescribeTargetGroupsInput, _ ...request.Option) (*elbv2.DescribeTargetGroupsOutput, error) {
+	return &elbv2.DescribeTargetGroupsOutput{
+		TargetGroups: []*elbv2.TargetGroup{
+			{TargetGroupArn: in.TargetGroupArns[0]},
+		},
+	}, nil
+}
+
+func (f *fakeELB) DescribeTargetHealthWithContext(_ aws.Context, _ *elbv2.DescribeTargetHealthInput, _ ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	return &elbv2.DescribeTargetHealthOutput{}, nil
+}
+
+func (f *fakeELB) RegisterTargetsWithContext(_ aws.Context, in *elbv2.RegisterTargetsInput, _ ...request.Option) (*elbv2.RegisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.registered = append(f.registered, in.Targets...)
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
@@ -0,0 +1,193 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+)
+
+// Elector elects a single leader among replicas with a lease item in a DynamoDB table.  The leader renews the lease
+// every RenewInterval.  If the leader stops renewing, a standby takes over once the lease expires, so failover takes
+// at most LeaseDuration + RenewInterval.  Lease expiry uses wall clock time, so replicas need roughly synced clocks.
+type Elector struct {
+	TableName string
+	Client    *dynamodb.DynamoDB
+	Log       *zapctx.Logger
+	// LeaseKey is the table key of the lease item
+	LeaseKey string
+	// Identity uniquely names this replica
+	Identity      string
+	LeaseDuration time.Duration
+	RenewInterval time.Duration
+
+	mu     sync.Mutex
+	status Status
+	now    func() time.Time
+}
+
+// Status is this replica's view of the election
+type Status struct {
+	IsLeader bool
+	// Leader is the identity holding the lease, if known
+	Leader         string
+	LeaseExpiresAt time.Time
+}
+
+type leaseObject struct {
+	Key    string
+	Holder string
+	// ExpireAt is in unix seconds, so it can be the table's TTL attribute
+	ExpireAt int64
+	// ExpireAtMillis is in unix milliseconds, so takeover conditions are precise
+	ExpireAtMillis int64
+}
+
+// IsLeader returns true while this replica holds an unexpired lease
+func (e *Elector) IsLeader() bool {
+	return e.Status().IsLeader
+}
+
+// Status returns this replica's view of the election
+func (e *Elector) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ret := e.status
+	// A leader that cannot renew must stop acting as leader once its lease runs out
+	ret.IsLeader = ret.IsLeader && e.currentTime().Before(ret.LeaseExpiresAt)
+	return ret
+}
+
+func (e *Elector) currentTime() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
+
+// Run campaigns for leadership until ctx is done, then gives up the lease so a standby can take over right away
+func (e *Elector) Run(ctx context.Context) {
+	e.campaign(ctx)
+	ticker := time.NewTicker(e.RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.release(context.Background())
+			return
+		case <-ticker.C:
+			e.campaign(ctx)
+		}
+	}
+}
+
+// campaign acquires or renews the lease.  It succeeds if nobody holds the lease, this replica already holds it, or
+// the holder let it expire.
+func (e *Elector) campaign(ctx context.Context) {
+	now := e.currentTime()
+	expireAt := now.Add(e.LeaseDuration)
+	item, err := dynamodbattribute.MarshalMap(leaseObject{
+		Key:            e.LeaseKey,
+		Holder:         e.Identity,
+		ExpireAt:       expireAt.Unix(),
+		ExpireAtMillis: expireAt.UnixMilli(),
+	})
+	if err != nil {
+		e.Log.IfErr(err).Error(ctx, "unable to marshal lease")
+		return
+	}
+	_, err = e.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           &e.TableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#key) OR #holder = :identity OR #expire < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":    aws.String("Key"),
+			"#holder": aws.String("Holder"),
+			"#expire": aws.String("ExpireAtMillis"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":identity": {S: aws.String(e.Identity)},
+			":now":      {N: aws.String(strconv.FormatInt(now.UnixMilli(), 10))},
+		},
+	})
+	if err == nil {
+		e.setStatus(ctx, Status{
+			IsLeader:       true,
+			Leader:         e.Identity,
+			LeaseExpiresAt: expireAt,
+		})
+		return
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		// Keep any lease we hold until it expires: Status stops reporting leader at expiry
+		e.Log.IfErr(err).Warn(ctx, "unable to campaign for leadership")
+		return
+	}
+	current, err := e.currentLease(ctx)
+	if err != nil {
+		e.Log.IfErr(err).Warn(ctx, "unable to read current lease")
+		current = &leaseObject{}
+	}
+	e.setStatus(ctx, Status{
+		Leader:         current.Holder,
+		LeaseExpiresAt: time.UnixMilli(current.ExpireAtMillis),
+	})
+}
+
+func (e *Elector) setStatus(ctx context.Context, s Status) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s.IsLeader != e.status.IsLeader || s.Leader != e.status.Leader {
+		e.Log.Info(ctx, "leader changed", zap.Bool("is_leader", s.IsLeader), zap.String("leader", s.Leader), zap.String("identity", e.Identity))
+	}
+	e.status = s
+}
+
+func (e *Elector) currentLease(ctx context.Context) (*leaseObject, error) {
+	out, err := e.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: &e.TableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(e.LeaseKey)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get lease: %w", err)
+	}
+	var ret leaseObject
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &ret); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal lease: %w", err)
+	}
+	return &ret, nil
+}
+
+func (e *Elector) release(ctx context.Context) {
+	if !e.IsLeader() {
+		return
+	}
+	_, err := e.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: &e.TableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {S: aws.String(e.LeaseKey)},
+		},
+		ConditionExpression: aws.String("#holder = :identity"),
+		ExpressionAttributeNames: map[string]*string{
+			"#holder": aws.String("Holder"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":identity": {S: aws.String(e.Identity)},
+		},
+	})
+	e.Log.IfErr(err).Warn(ctx, "unable to release lease")
+	e.setStatus(ctx, Status{})
+}
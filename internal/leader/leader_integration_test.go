@@ -0,0 +1,61 @@
+// +build integration
+
+package leader_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/cresta/hostname-for-target-group/internal/leader"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElector(t *testing.T) {
+	if os.Getenv("DYNAMODB_TABLE") == "" {
+		t.Skip("skipping test: expect env DYNAMODB_TABLE=<dynamo_table>")
+	}
+	ses, err := session.NewSession()
+	require.NoError(t, err)
+	leaseKey := fmt.Sprintf("TestElector:%s", time.Now())
+	newElector := func(identity string) *leader.Elector {
+		return &leader.Elector{
+			TableName:     os.Getenv("DYNAMODB_TABLE"),
+			Client:        dynamodb.New(ses),
+			Log:           testhelp.ZapTestingLogger(t),
+			LeaseKey:      leaseKey,
+			Identity:      identity,
+			LeaseDuration: time.Second * 3,
+			RenewInterval: time.Second,
+		}
+	}
+	first := newElector("first")
+	second := newElector("second")
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		first.Run(firstCtx)
+	}()
+	require.Eventually(t, first.IsLeader, time.Second*5, time.Millisecond*100)
+
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	go second.Run(secondCtx)
+	require.Eventually(t, func() bool {
+		return second.Status().Leader == "first"
+	}, time.Second*5, time.Millisecond*100)
+	require.False(t, second.IsLeader())
+
+	// Releasing the lease on shutdown should hand leadership over
+	cancelFirst()
+	<-firstDone
+	require.False(t, first.IsLeader())
+	require.Eventually(t, second.IsLeader, time.Second*5, time.Millisecond*100)
+}
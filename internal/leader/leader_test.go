@@ -0,0 +1,191 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDynamoDB is a local DynamoDB stand-in for a table keyed by "Key".  It only understands the conditions the
+// Elector writes leases with.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+type fakeDynamoDBRequest struct {
+	Key                       map[string]*dynamodb.AttributeValue
+	Item                      map[string]*dynamodb.AttributeValue
+	ConditionExpression       string
+	ExpressionAttributeValues map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var in fakeDynamoDBRequest
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]interface{}{}
+	switch strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "GetItem":
+		if item, exists := f.items[*in.Key["Key"].S]; exists {
+			out["Item"] = stripNulls(item)
+		}
+	case "PutItem":
+		key := *in.Item["Key"].S
+		if !f.conditionHolds(f.items[key], in) {
+			conditionFailed(rw)
+			return
+		}
+		f.items[key] = in.Item
+	case "DeleteItem":
+		key := *in.Key["Key"].S
+		if !f.conditionHolds(f.items[key], in) {
+			conditionFailed(rw)
+			return
+		}
+		delete(f.items, key)
+	default:
+		http.Error(rw, "unsupported operation", http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	_ = json.NewEncoder(rw).Encode(out)
+}
+
+// conditionHolds checks the lease conditions: nobody holds the lease, the caller holds it, or it expired
+func (f *fakeDynamoDB) conditionHolds(existing map[string]*dynamodb.AttributeValue, in fakeDynamoDBRequest) bool {
+	if in.ConditionExpression == "" {
+		return true
+	}
+	if existing == nil {
+		return strings.Contains(in.ConditionExpression, "attribute_not_exists")
+	}
+	if *existing["Holder"].S == *in.ExpressionAttributeValues[":identity"].S {
+		return true
+	}
+	now, exists := in.ExpressionAttributeValues[":now"]
+	if !exists {
+		return false
+	}
+	expireAt, _ := strconv.ParseInt(*existing["ExpireAtMillis"].N, 10, 64)
+	nowMillis, _ := strconv.ParseInt(*now.N, 10, 64)
+	return expireAt < nowMillis
+}
+
+func conditionFailed(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	rw.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(rw).Encode(map[string]string{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + dynamodb.ErrCodeConditionalCheckFailedException,
+		"message": "The conditional request failed",
+	})
+}
+
+// stripNulls drops the unset fields of attribute values, since the SDK structs have no omitempty tags
+func stripNulls(item map[string]*dynamodb.AttributeValue) interface{} {
+	b, _ := json.Marshal(item)
+	var generic map[string]map[string]interface{}
+	_ = json.Unmarshal(b, &generic)
+	for _, attr := range generic {
+		for k, v := range attr {
+			if v == nil {
+				delete(attr, k)
+			}
+		}
+	}
+	return generic
+}
+
+func newTestElectors(t *testing.T, now *time.Time, identities ...string) ([]*Elector, *fakeDynamoDB) {
+	fake := &fakeDynamoDB{
+		items: make(map[string]map[string]*dynamodb.AttributeValue),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	ses, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	require.NoError(t, err)
+	ret := make([]*Elector, 0, len(identities))
+	for _, identity := range identities {
+		ret = append(ret, &Elector{
+			TableName:     "test",
+			Client:        dynamodb.New(ses),
+			Log:           testhelp.ZapTestingLogger(t),
+			LeaseKey:      "leader_test",
+			Identity:      identity,
+			LeaseDuration: time.Second * 30,
+			RenewInterval: time.Second * 10,
+			now: func() time.Time {
+				return *now
+			},
+		})
+	}
+	return ret, fake
+}
+
+func TestElectorLease(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	electors, fake := newTestElectors(t, &now, "first", "second")
+	first, second := electors[0], electors[1]
+	ctx := context.Background()
+
+	// Acquire
+	first.campaign(ctx)
+	require.True(t, first.IsLeader())
+	item := fake.items["leader_test"]
+	require.Equal(t, "first", *item["Holder"].S)
+	require.Equal(t, strconv.FormatInt(now.Add(time.Second*30).Unix(), 10), *item["ExpireAt"].N, "ExpireAt can be the table's TTL attribute")
+
+	second.campaign(ctx)
+	require.False(t, second.IsLeader())
+	status := second.Status()
+	require.Equal(t, "first", status.Leader)
+	require.True(t, now.Add(time.Second*30).Equal(status.LeaseExpiresAt))
+
+	// Renew
+	now = now.Add(time.Second * 20)
+	first.campaign(ctx)
+	require.True(t, first.IsLeader())
+	require.True(t, now.Add(time.Second*30).Equal(first.Status().LeaseExpiresAt))
+	second.campaign(ctx)
+	require.False(t, second.IsLeader(), "a renewed lease is not taken over")
+
+	// The leader stops renewing, and loses the lease once it expires
+	now = now.Add(time.Second * 31)
+	require.False(t, first.IsLeader())
+	second.campaign(ctx)
+	require.True(t, second.IsLeader(), "an expired lease is taken over")
+	first.campaign(ctx)
+	require.False(t, first.IsLeader())
+	require.Equal(t, "second", first.Status().Leader)
+
+	// A replica that lost the lease does not release it
+	first.release(ctx)
+	require.Contains(t, fake.items, "leader_test")
+	second.release(ctx)
+	require.False(t, second.IsLeader())
+	require.NotContains(t, fake.items, "leader_test")
+	first.campaign(ctx)
+	require.True(t, first.IsLeader(), "a released lease is taken at once")
+}
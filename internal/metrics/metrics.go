@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "hostname_for_target_group"
+
+// Metrics records sync health.  A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	syncDuration      prometheus.Histogram
+	targetGroupSyncs  *prometheus.CounterVec
+	targetsAdded      *prometheus.CounterVec
+	targetsRemoved    *prometheus.CounterVec
+	removalsHeld      *prometheus.CounterVec
+	dnsLookupFailures *prometheus.CounterVec
+	dnsDisagreements  *prometheus.CounterVec
+	cnameChanges      *prometheus.CounterVec
+	dynamoDBLatency   *prometheus.HistogramVec
+	tagFinderResults  prometheus.Gauge
+	lastSuccess       *lastSuccessCollector
+}
+
+// New creates metrics and registers them with reg
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	ret := &Metrics{
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "sync_duration_seconds",
+			Help:      "Time taken to sync every target group",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		}),
+		targetGroupSyncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_group_syncs_total",
+			Help:      "Syncs of a single target group, by result",
+		}, []string{"target_group", "result"}),
+		targetsAdded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "targets_added_total",
+			Help:      "IPs registered with a target group",
+		}, []string{"target_group"}),
+		targetsRemoved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "targets_removed_total",
+			Help:      "IPs deregistered from a target group",
+		}, []string{"target_group"}),
+		removalsHeld: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "removals_held_total",
+			Help:      "IPs not deregistered from a target group, by whether the shrink limit or minimum targets held them",
+		}, []string{"target_group", "reason"}),
+		dnsLookupFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_lookup_failures_total",
+			Help:      "Failed DNS lookups, by index of the resolver in DNS_SERVERS",
+		}, []string{"resolver_index"}),
+		dnsDisagreements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_disagreements_total",
+			Help:      "Lookups where DNS servers returned different addresses, by DNS_QUORUM",
+		}, []string{"quorum"}),
+		cnameChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cname_target_changes_total",
+			Help:      "Hostnames of a target group whose CNAME chain ended at a new canonical name",
+		}, []string{"target_group"}),
+		dynamoDBLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dynamodb_request_duration_seconds",
+			Help:      "Latency of DynamoDB requests, by operation",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"operation"}),
+		tagFinderResults: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tag_finder_target_groups",
+			Help:      "Target groups found by the most recent tag search",
+		}),
+		lastSuccess: &lastSuccessCollector{
+			desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "last_successful_sync_age_seconds"),
+				"Seconds since a target group last synced successfully", []string{"target_group"}, nil),
+			lastSuccess: make(map[string]time.Time),
+			now:         time.Now,
+		},
+	}
+	for _, c := range []prometheus.Collector{ret.syncDuration, ret.targetGroupSyncs, ret.targetsAdded, ret.targetsRemoved, ret.removalsHeld, ret.dnsLookupFailures, ret.dnsDisagreements, ret.cnameChanges, ret.dynamoDBLatency, ret.tagFinderResults, ret.lastSuccess} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// ObserveSync records how long a full sync took
+func (m *Metrics) ObserveSync(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.syncDuration.Observe(d.Seconds())
+}
+
+// TargetGroupSynced records the result of syncing a single target group
+func (m *Metrics) TargetGroupSynced(targetGroup string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.targetGroupSyncs.WithLabelValues(targetGroup, "failure").Inc()
+		return
+	}
+	m.targetGroupSyncs.WithLabelValues(targetGroup, "success").Inc()
+	m.lastSuccess.set(targetGroup)
+}
+
+// TargetsChanged records IPs registered and deregistered from a target group
+func (m *Metrics) TargetsChanged(targetGroup string, added int, removed int) {
+	if m == nil {
+		return
+	}
+	m.targetsAdded.WithLabelValues(targetGroup).Add(float64(added))
+	m.targetsRemoved.WithLabelValues(targetGroup).Add(float64(removed))
+}
+
+// RemovalsHeld records IPs held back from deregistration, and why
+func (m *Metrics) RemovalsHeld(targetGroup string, reason string, held int) {
+	if m == nil {
+		return
+	}
+	m.removalsHeld.WithLabelValues(targetGroup, reason).Add(float64(held))
+}
+
+// DNSLookupFailed records a failed lookup against a single resolver
+func (m *Metrics) DNSLookupFailed(resolverIndex string) {
+	if m == nil {
+		return
+	}
+	m.dnsLookupFailures.WithLabelValues(resolverIndex).Inc()
+}
+
+// DNSDisagreement records a lookup where the DNS servers of a quorum returned different addresses
+func (m *Metrics) DNSDisagreement(quorum string) {
+	if m == nil {
+		return
+	}
+	m.dnsDisagreements.WithLabelValues(quorum).Inc()
+}
+
+// CanonicalNameChanged records a hostname of a target group whose CNAME chain ended somewhere new
+func (m *Metrics) CanonicalNameChanged(targetGroup string) {
+	if m == nil {
+		return
+	}
+	m.cnameChanges.WithLabelValues(targetGroup).Inc()
+}
+
+// ObserveDynamoDB records the latency of a DynamoDB operation started at start
+func (m *Metrics) ObserveDynamoDB(operation string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.dynamoDBLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// TagFinderResults records how many target groups a tag search found
+func (m *Metrics) TagFinderResults(count int) {
+	if m == nil {
+		return
+	}
+	m.tagFinderResults.Set(float64(count))
+}
+
+// lastSuccessCollector reports age rather than a timestamp, so alerts do not need to do time math
+type lastSuccessCollector struct {
+	desc        *prometheus.Desc
+	lastSuccess map[string]time.Time
+	now         func() time.Time
+	mu          sync.Mutex
+}
+
+func (l *lastSuccessCollector) set(targetGroup string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSuccess[targetGroup] = l.now()
+}
+
+func (l *lastSuccessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.desc
+}
+
+func (l *lastSuccessCollector) Collect(ch chan<- prometheus.Metric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for tg, t := range l.lastSuccess {
+		ch <- prometheus.MustNewConstMetric(l.desc, prometheus.GaugeValue, now.Sub(t).Seconds(), tg)
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	require.NoError(t, err)
+	now := time.Unix(1000, 0)
+	m.lastSuccess.now = func() time.Time {
+		return now
+	}
+	m.TargetGroupSynced("arn:a", nil)
+	m.TargetGroupSynced("arn:a", errors.New("bad"))
+	m.TargetsChanged("arn:a", 2, 1)
+	m.RemovalsHeld("arn:a", "shrink limit", 4)
+	m.DNSDisagreement("majority")
+	m.CanonicalNameChanged("arn:a")
+	now = now.Add(time.Second * 30)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(m.targetGroupSyncs.WithLabelValues("arn:a", "failure")))
+	require.Equal(t, 2.0, testutil.ToFloat64(m.targetsAdded.WithLabelValues("arn:a")))
+	require.Equal(t, 4.0, testutil.ToFloat64(m.removalsHeld.WithLabelValues("arn:a", "shrink limit")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.dnsDisagreements.WithLabelValues("majority")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.cnameChanges.WithLabelValues("arn:a")))
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP hostname_for_target_group_last_successful_sync_age_seconds Seconds since a target group last synced successfully
+# TYPE hostname_for_target_group_last_successful_sync_age_seconds gauge
+hostname_for_target_group_last_successful_sync_age_seconds{target_group="arn:a"} 30
+`), "hostname_for_target_group_last_successful_sync_age_seconds"))
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObserveSync(time.Second)
+	m.TargetGroupSynced("arn:a", nil)
+	m.TargetsChanged("arn:a", 1, 1)
+	m.RemovalsHeld("arn:a", "minimum targets", 1)
+	m.DNSLookupFailed("0")
+	m.DNSDisagreement("union")
+	m.CanonicalNameChanged("arn:a")
+	m.ObserveDynamoDB("GetItem", time.Now())
+	m.TagFinderResults(1)
+}
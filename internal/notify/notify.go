@@ -0,0 +1,274 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// Notification is everything worth telling about a single sync
+type Notification struct {
+	Time     time.Time `json:"time"`
+	Changes  []Change  `json:"changes,omitempty"`
+	Failures []Failure `json:"failures,omitempty"`
+}
+
+// Change is the targets a sync registered with and deregistered from a target group
+type Change struct {
+	TargetGroupARN string   `json:"targetGroupARN"`
+	Hostnames      []string `json:"hostnames"`
+	Added          []string `json:"added,omitempty"`
+	Removed        []string `json:"removed,omitempty"`
+}
+
+// Failure is a target group that failed to sync several times in a row
+type Failure struct {
+	TargetGroupARN string   `json:"targetGroupARN"`
+	Hostnames      []string `json:"hostnames"`
+	// Failures is how many syncs in a row failed
+	Failures int    `json:"failures"`
+	Error    string `json:"error"`
+}
+
+// Empty returns true if there is nothing to notify about
+func (n Notification) Empty() bool {
+	return len(n.Changes) == 0 && len(n.Failures) == 0
+}
+
+// Summary is a short, human readable description of the notification
+func (n Notification) Summary() string {
+	var lines []string
+	for _, c := range n.Changes {
+		line := fmt.Sprintf("%s (%s):", c.TargetGroupARN, strings.Join(c.Hostnames, ", "))
+		if len(c.Added) > 0 {
+			line += " registered " + strings.Join(c.Added, ", ")
+		}
+		if len(c.Removed) > 0 {
+			if len(c.Added) > 0 {
+				line += ";"
+			}
+			line += " deregistered " + strings.Join(c.Removed, ", ")
+		}
+		lines = append(lines, line)
+	}
+	for _, f := range n.Failures {
+		lines = append(lines, fmt.Sprintf("%s (%s): failed %d syncs in a row: %s", f.TargetGroupARN, strings.Join(f.Hostnames, ", "), f.Failures, f.Error))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Notifier is told about target group changes and failures once per sync
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// SignatureHeader is the webhook header holding the hex encoded HMAC-SHA256 of the body, prefixed with "sha256="
+const SignatureHeader = "X-Hostname-For-Target-Group-Signature-256"
+
+// Webhook posts the notification as JSON
+type Webhook struct {
+	URL string
+	// Secret signs the body in SignatureHeader.  Empty sends no signature.
+	Secret string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("unable to encode notification: %w", err)
+	}
+	headers := map[string]string{}
+	if w.Secret != "" {
+		headers[SignatureHeader] = "sha256=" + Sign(w.Secret, body)
+	}
+	return postJSON(ctx, w.Client, w.URL, body, headers)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var _ Notifier = &Webhook{}
+
+// Slack posts the notification's summary to a Slack compatible incoming webhook
+type Slack struct {
+	URL string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (s *Slack) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(map[string]string{
+		"text": n.Summary(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode notification: %w", err)
+	}
+	return postJSON(ctx, s.Client, s.URL, body, nil)
+}
+
+var _ Notifier = &Slack{}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to post notification: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected notification response status %s", resp.Status)
+	}
+	return nil
+}
+
+// SNS publishes the notification as JSON to a topic, with its summary as the subject
+type SNS struct {
+	TopicARN string
+	Client   *sns.SNS
+}
+
+// maxSNSSubjectLength is the longest subject SNS accepts
+const maxSNSSubjectLength = 100
+
+func (s *SNS) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("unable to encode notification: %w", err)
+	}
+	subject := fmt.Sprintf("hostname-for-target-group: %d changed, %d failing", len(n.Changes), len(n.Failures))
+	if len(subject) > maxSNSSubjectLength {
+		subject = subject[:maxSNSSubjectLength]
+	}
+	_, err = s.Client.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.TopicARN),
+		Subject:  aws.String(subject),
+		Message:  aws.String(string(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish notification: %w", err)
+	}
+	return nil
+}
+
+var _ Notifier = &SNS{}
+
+// Multi notifies every notifier, even if some fail
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, n Notification) error {
+	var firstErr error
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, n); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+var _ Notifier = Multi{}
+
+// RateLimited sends at most one notification per Interval.  Notifications that arrive sooner are merged and sent once
+// the interval passes, even if nothing else arrives.
+type RateLimited struct {
+	Notifier Notifier
+	Interval time.Duration
+	// Now defaults to time.Now
+	Now func() time.Time
+	// OnError is told about failures of merged notifications sent once the interval passes, which have no caller to
+	// return an error to
+	OnError func(err error)
+
+	lastSent time.Time
+	pending  Notification
+	flush    *time.Timer
+	mu       sync.Mutex
+}
+
+func (r *RateLimited) Notify(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	r.pending.Time = n.Time
+	r.pending.Changes = append(r.pending.Changes, n.Changes...)
+	r.pending.Failures = append(r.pending.Failures, n.Failures...)
+	if r.pending.Empty() {
+		r.mu.Unlock()
+		return nil
+	}
+	if wait := r.Interval - r.now().Sub(r.lastSent); wait > 0 {
+		if r.flush == nil {
+			r.flush = time.AfterFunc(wait, r.sendPending)
+		}
+		r.mu.Unlock()
+		return nil
+	}
+	toSend := r.takePending()
+	r.mu.Unlock()
+	// Not under r.mu, so a slow notifier does not hold up the next sync
+	return r.Notifier.Notify(ctx, toSend)
+}
+
+// sendPending sends the merged notifications once the interval passes
+func (r *RateLimited) sendPending() {
+	r.mu.Lock()
+	if r.pending.Empty() || r.now().Sub(r.lastSent) < r.Interval {
+		// Already sent by Notify, which may have scheduled another flush
+		r.mu.Unlock()
+		return
+	}
+	toSend := r.takePending()
+	r.mu.Unlock()
+	if err := r.Notifier.Notify(context.Background(), toSend); err != nil && r.OnError != nil {
+		r.OnError(err)
+	}
+}
+
+// takePending returns the pending notification and counts it as sent.  r.mu must be held.
+func (r *RateLimited) takePending() Notification {
+	if r.flush != nil {
+		r.flush.Stop()
+		r.flush = nil
+	}
+	ret := r.pending
+	r.pending = Notification{}
+	r.lastSent = r.now()
+	return ret
+}
+
+func (r *RateLimited) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+var _ Notifier = &RateLimited{}
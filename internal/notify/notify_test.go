@@ -0,0 +1,230 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/cresta/hostname-for-target-group/internal/notify"
+	"github.com/stretchr/testify/require"
+)
+
+func testNotification() notify.Notification {
+	return notify.Notification{
+		Time: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC),
+		Changes: []notify.Change{
+			{
+				TargetGroupARN: "arn:a",
+				Hostnames:      []string{"a.example.com"},
+				Added:          []string{"1.2.3.4"},
+				Removed:        []string{"1.2.3.5"},
+			},
+		},
+		Failures: []notify.Failure{
+			{
+				TargetGroupARN: "arn:b",
+				Hostnames:      []string{"b.example.com"},
+				Failures:       3,
+				Error:          "no such host",
+			},
+		},
+	}
+}
+
+// recordRequests returns a server that remembers the last request body and headers
+func recordRequests(t *testing.T, status int) (*httptest.Server, *[]byte, *http.Header) {
+	var body []byte
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		body = b
+		headers = req.Header
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &body, &headers
+}
+
+func TestWebhook(t *testing.T) {
+	server, body, headers := recordRequests(t, http.StatusOK)
+	w := &notify.Webhook{URL: server.URL, Secret: "secret"}
+	require.NoError(t, w.Notify(context.Background(), testNotification()))
+	var got notify.Notification
+	require.NoError(t, json.Unmarshal(*body, &got))
+	require.Equal(t, testNotification(), got)
+	require.Equal(t, "application/json", headers.Get("Content-Type"))
+	require.Equal(t, "sha256="+notify.Sign("secret", *body), headers.Get(notify.SignatureHeader))
+
+	w = &notify.Webhook{URL: server.URL}
+	require.NoError(t, w.Notify(context.Background(), testNotification()))
+	require.Empty(t, headers.Get(notify.SignatureHeader), "no secret, no signature")
+
+	failing, _, _ := recordRequests(t, http.StatusInternalServerError)
+	w = &notify.Webhook{URL: failing.URL}
+	require.Error(t, w.Notify(context.Background(), testNotification()))
+}
+
+func TestSign(t *testing.T) {
+	// echo -n 'body' | openssl dgst -sha256 -hmac secret
+	require.Equal(t, "dc46983557fea127b43af721467eb9b3fde2338fe3e14f51952aa8478c13d355", notify.Sign("secret", []byte("body")))
+}
+
+func TestSlack(t *testing.T) {
+	server, body, _ := recordRequests(t, http.StatusOK)
+	s := &notify.Slack{URL: server.URL}
+	require.NoError(t, s.Notify(context.Background(), testNotification()))
+	var got map[string]string
+	require.NoError(t, json.Unmarshal(*body, &got))
+	require.Equal(t, "arn:a (a.example.com): registered 1.2.3.4; deregistered 1.2.3.5\narn:b (b.example.com): failed 3 syncs in a row: no such host", got["text"])
+}
+
+func TestSNS(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		form = req.PostForm
+		_, _ = rw.Write([]byte(`<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>`))
+	}))
+	defer server.Close()
+	ses, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	require.NoError(t, err)
+	s := &notify.SNS{TopicARN: "arn:topic", Client: sns.New(ses)}
+	require.NoError(t, s.Notify(context.Background(), testNotification()))
+	require.Equal(t, "Publish", form.Get("Action"))
+	require.Equal(t, "arn:topic", form.Get("TopicArn"))
+	require.Equal(t, "hostname-for-target-group: 1 changed, 1 failing", form.Get("Subject"))
+	var got notify.Notification
+	require.NoError(t, json.Unmarshal([]byte(form.Get("Message")), &got))
+	require.Equal(t, testNotification(), got)
+}
+
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []notify.Notification
+	err  error
+}
+
+func (r *recordingNotifier) Notify(_ context.Context, n notify.Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, n)
+	return r.err
+}
+
+func (r *recordingNotifier) notifications() []notify.Notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]notify.Notification(nil), r.sent...)
+}
+
+func TestMulti(t *testing.T) {
+	failing := &recordingNotifier{err: errors.New("unable to notify")}
+	working := &recordingNotifier{}
+	require.Error(t, notify.Multi{failing, working}.Notify(context.Background(), testNotification()))
+	require.Len(t, working.notifications(), 1, "later notifiers are still told")
+}
+
+func TestRateLimited(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	inner := &recordingNotifier{}
+	r := &notify.RateLimited{
+		Notifier: inner,
+		Interval: time.Minute,
+		Now: func() time.Time {
+			return now
+		},
+	}
+	ctx := context.Background()
+	require.NoError(t, r.Notify(ctx, testNotification()))
+	require.Len(t, inner.notifications(), 1)
+
+	// Within the interval, notifications are held and merged
+	now = now.Add(time.Second * 30)
+	require.NoError(t, r.Notify(ctx, testNotification()))
+	require.NoError(t, r.Notify(ctx, notify.Notification{}))
+	require.Len(t, inner.notifications(), 1)
+
+	now = now.Add(time.Second * 30)
+	require.NoError(t, r.Notify(ctx, testNotification()))
+	sent := inner.notifications()
+	require.Len(t, sent, 2)
+	require.Len(t, sent[1].Changes, 2)
+	require.Len(t, sent[1].Failures, 2)
+
+	// Nothing pending, nothing sent
+	now = now.Add(time.Hour)
+	require.NoError(t, r.Notify(ctx, notify.Notification{}))
+	require.Len(t, inner.notifications(), 2)
+}
+
+// blockingNotifier blocks each notification until release is closed
+type blockingNotifier struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingNotifier) Notify(_ context.Context, _ notify.Notification) error {
+	b.started <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func TestRateLimitedSendsUnlocked(t *testing.T) {
+	inner := &blockingNotifier{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	r := &notify.RateLimited{
+		Notifier: inner,
+		Interval: time.Hour,
+	}
+	ctx := context.Background()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- r.Notify(ctx, testNotification())
+	}()
+	<-inner.started
+	// The first notification is still being sent, and the next is held without waiting for it
+	require.NoError(t, r.Notify(ctx, testNotification()))
+	close(inner.release)
+	require.NoError(t, <-sent)
+}
+
+func TestRateLimitedFlushes(t *testing.T) {
+	inner := &recordingNotifier{err: errors.New("unable to notify")}
+	errs := make(chan error, 1)
+	r := &notify.RateLimited{
+		Notifier: inner,
+		Interval: time.Millisecond * 50,
+		OnError: func(err error) {
+			errs <- err
+		},
+	}
+	ctx := context.Background()
+	require.Error(t, r.Notify(ctx, testNotification()))
+	require.NoError(t, r.Notify(ctx, testNotification()), "held notifications have no error yet")
+	require.Len(t, inner.notifications(), 1)
+
+	// The held notification is sent once the interval passes, without another call to Notify
+	require.Error(t, <-errs)
+	sent := inner.notifications()
+	require.Len(t, sent, 2)
+	require.Len(t, sent[1].Changes, 1)
+}
@@ -2,12 +2,16 @@ package state
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
 	"github.com/cresta/zapctx"
 	"go.uber.org/zap"
 )
@@ -17,11 +21,15 @@ type DynamoDBStorage struct {
 	Log             *zapctx.Logger
 	Client          *dynamodb.DynamoDB
 	SyncCachePrefix string
+	// Metrics is optional and records request latency
+	Metrics *metrics.Metrics
 }
 
 type storageObject struct {
-	Key      string
-	TgARN    string
+	Key   string
+	TgARN string
+	// Hostname is the comma separated set of hostnames.  The attribute name predates multiple hostnames and is kept
+	// so existing items still load.
 	Hostname string
 	State    State
 }
@@ -40,6 +48,7 @@ func (d *DynamoDBStorage) GetStates(ctx context.Context, syncPairs []Keys) (map[
 			},
 		})
 	}
+	start := time.Now()
 	res, err := d.Client.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
 		RequestItems: map[string]*dynamodb.KeysAndAttributes{
 			d.TableName: {
@@ -47,6 +56,7 @@ func (d *DynamoDBStorage) GetStates(ctx context.Context, syncPairs []Keys) (map[
 			},
 		},
 	})
+	d.Metrics.ObserveDynamoDB("BatchGetItem", start)
 	if err != nil {
 		d.Log.IfErr(err).Warn(ctx, "unable to fetch items", zap.Any("items", syncPairs))
 		return nil, fmt.Errorf("unable to fetch items: %w", err)
@@ -58,10 +68,7 @@ func (d *DynamoDBStorage) GetStates(ctx context.Context, syncPairs []Keys) (map[
 		if err := dynamodbattribute.UnmarshalMap(vals, &into); err != nil {
 			return nil, fmt.Errorf("unable to unmarshal item %d: %w", idx, err)
 		}
-		ret[Keys{
-			TargetGroupARN: TargetGroupARN(into.TgARN),
-			Hostname:       into.Hostname,
-		}] = into.State
+		ret[NewKeys(TargetGroupARN(into.TgARN), ParseHostnames(into.Hostname))] = into.State
 	}
 	// Fill in missing values
 	for _, sp := range syncPairs {
@@ -73,124 +80,190 @@ func (d *DynamoDBStorage) GetStates(ctx context.Context, syncPairs []Keys) (map[
 	return ret, nil
 }
 
+// Store writes each state only if the stored version is the one it was derived from.  States that lost a race with
+// another writer are skipped and returned in a *VersionConflictError.
 func (d *DynamoDBStorage) Store(ctx context.Context, toStore map[Keys]State) error {
 	d.Log.Debug(ctx, "<- Store", zap.Any("pairs", toStore))
 	defer d.Log.Debug(ctx, "-> Store")
-	if len(toStore) == 0 {
-		return nil
+	var conflicts []Keys
+	for k, v := range toStore {
+		err := d.storeSingle(ctx, k, v)
+		if isConditionalCheckFailed(err) {
+			d.Log.Debug(ctx, "version conflict", zap.Stringer("key", k), zap.Int("version", v.Version))
+			conflicts = append(conflicts, k)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write %s to dynamodb: %w", k, err)
+		}
 	}
-	values, err := makeWriteRequest(toStore)
-	if err != nil {
-		return fmt.Errorf("unable to create dynamodb write object: %w", err)
+	if len(conflicts) > 0 {
+		return &VersionConflictError{Keys: conflicts}
 	}
-	_, err = d.Client.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
-		RequestItems: map[string][]*dynamodb.WriteRequest{
-			d.TableName: values,
+	return nil
+}
+
+func (d *DynamoDBStorage) storeSingle(ctx context.Context, k Keys, v State) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"Key": {
+			S: aws.String(k.String()),
 		},
+	}
+	condition, names, values := versionCondition(v.Version - 1)
+	if len(v.Targets) == 0 {
+		start := time.Now()
+		_, err := d.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 &d.TableName,
+			Key:                       key,
+			ConditionExpression:       condition,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+		d.Metrics.ObserveDynamoDB("DeleteItem", start)
+		return err
+	}
+	encoded, err := dynamodbattribute.MarshalMap(storageObject{
+		Key:      k.String(),
+		TgARN:    string(k.TargetGroupARN),
+		Hostname: k.Hostnames,
+		State:    v,
 	})
 	if err != nil {
-		return fmt.Errorf("unable to write to dynamodb: %w", err)
+		return fmt.Errorf("unable to marshal object %s: %w", k, err)
 	}
-	return nil
+	start := time.Now()
+	_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 &d.TableName,
+		Item:                      encoded,
+		ConditionExpression:       condition,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	d.Metrics.ObserveDynamoDB("PutItem", start)
+	return err
 }
 
-func makeWriteRequest(store map[Keys]State) ([]*dynamodb.WriteRequest, error) {
-	ret := make([]*dynamodb.WriteRequest, 0, len(store))
-	for k, v := range store {
-		if len(v.Targets) == 0 {
-			ret = append(ret, &dynamodb.WriteRequest{
-				DeleteRequest: &dynamodb.DeleteRequest{
-					Key: map[string]*dynamodb.AttributeValue{
-						"Key": {
-							S: aws.String(k.String()),
-						},
-					},
-				},
-			})
-			continue
-		}
-		so := storageObject{
-			Key:      k.String(),
-			TgARN:    string(k.TargetGroupARN),
-			Hostname: k.Hostname,
-			State:    v,
-		}
-		encoded, err := dynamodbattribute.MarshalMap(so)
-		if err != nil {
-			return nil, fmt.Errorf("unable to marshal object %s: %w", k, err)
-		}
-		ret = append(ret, &dynamodb.WriteRequest{
-			PutRequest: &dynamodb.PutRequest{
-				Item: encoded,
-			},
-		})
+// versionCondition requires the stored state to be at expectedVersion.  Version 0 means the state was never stored.
+func versionCondition(expectedVersion int) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	if expectedVersion <= 0 {
+		return aws.String("attribute_not_exists(#key)"), map[string]*string{
+			"#key": aws.String("Key"),
+		}, nil
 	}
-	return ret, nil
+	return aws.String("#state.#version = :version"), map[string]*string{
+		"#state":   aws.String("State"),
+		"#version": aws.String("Version"),
+	}, map[string]*dynamodb.AttributeValue{
+		":version": {
+			N: aws.String(strconv.Itoa(expectedVersion)),
+		},
+	}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
 }
 
+// syncCacheObject is the stored tag sync cache.  ExpireAt is in unix seconds so it can be the table's TTL attribute.
+// Items written before Mappings existed stored ExpireAt as a string and nothing else: see isLegacySyncCacheItem.
 type syncCacheObject struct {
 	Key      string
-	ExpireAt time.Time
-	cache    map[TargetGroupARN]string
+	ExpireAt int64
+	Mappings map[TargetGroupARN]Mapping
 }
 
-func (d *DynamoDBStorage) StoreSync(ctx context.Context, toStore map[TargetGroupARN]string, expireAt time.Time) error {
+func (d *DynamoDBStorage) StoreSync(ctx context.Context, toStore map[TargetGroupARN]Mapping, expireAt time.Time) error {
 	if toStore == nil {
-		_, err := d.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
-			Key:       d.cacheKey(),
-			TableName: &d.TableName,
-		})
-		if err != nil {
+		if err := d.deleteSyncCache(ctx); err != nil {
 			return fmt.Errorf("unable to clear cache: %w", err)
 		}
 		return nil
 	}
 	dynamodbObject := syncCacheObject{
-		Key:      "synccache_" + d.SyncCachePrefix,
-		ExpireAt: expireAt,
-		cache:    toStore,
+		Key:      d.cacheKeyString(),
+		ExpireAt: expireAt.Unix(),
+		Mappings: toStore,
 	}
 	encoded, err := dynamodbattribute.MarshalMap(dynamodbObject)
 	if err != nil {
 		return fmt.Errorf("unable to encode cache object: %w", err)
 	}
+	start := time.Now()
 	_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
 		Item:      encoded,
 		TableName: &d.TableName,
 	})
+	d.Metrics.ObserveDynamoDB("PutItem", start)
 	if err != nil {
-		return fmt.Errorf("unable t o write object to cache: %w", err)
+		return fmt.Errorf("unable to write object to cache: %w", err)
 	}
 	return nil
 }
 
+func (d *DynamoDBStorage) deleteSyncCache(ctx context.Context) error {
+	start := time.Now()
+	_, err := d.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key:       d.cacheKey(),
+		TableName: &d.TableName,
+	})
+	d.Metrics.ObserveDynamoDB("DeleteItem", start)
+	return err
+}
+
+func (d *DynamoDBStorage) cacheKeyString() string {
+	return "synccache_" + d.SyncCachePrefix
+}
+
 func (d *DynamoDBStorage) cacheKey() map[string]*dynamodb.AttributeValue {
 	return map[string]*dynamodb.AttributeValue{
 		"Key": {
-			S: aws.String("synccache_" + d.SyncCachePrefix),
+			S: aws.String(d.cacheKeyString()),
 		},
 	}
 }
 
-func (d *DynamoDBStorage) GetSync(ctx context.Context, currentTime time.Time) (map[TargetGroupARN]string, error) {
+// isLegacySyncCacheItem is true for cache items written by older versions, which stored ExpireAt as a timestamp string
+// and lost the cached mappings entirely.  They are never valid and never expire on their own with a TTL attribute.
+func isLegacySyncCacheItem(item map[string]*dynamodb.AttributeValue) bool {
+	expireAt, exists := item["ExpireAt"]
+	return exists && expireAt.S != nil
+}
+
+func (d *DynamoDBStorage) GetSync(ctx context.Context, currentTime time.Time) (map[TargetGroupARN]Mapping, error) {
+	start := time.Now()
 	out, err := d.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		Key:       d.cacheKey(),
-		TableName: &d.TableName,
+		Key:            d.cacheKey(),
+		TableName:      &d.TableName,
+		ConsistentRead: aws.Bool(true),
 	})
+	d.Metrics.ObserveDynamoDB("GetItem", start)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get cached tag state: %w", err)
 	}
 	if len(out.Item) == 0 {
 		return nil, nil
 	}
+	if isLegacySyncCacheItem(out.Item) {
+		d.Log.Info(ctx, "removing sync cache item written by an older version")
+		if err := d.deleteSyncCache(ctx); err != nil {
+			d.Log.IfErr(err).Warn(ctx, "unable to remove old sync cache item")
+		}
+		return nil, nil
+	}
 	var cachedObject syncCacheObject
 	if err := dynamodbattribute.UnmarshalMap(out.Item, &cachedObject); err != nil {
 		return nil, fmt.Errorf("unable to unmarshal map: %w", err)
 	}
-	if cachedObject.ExpireAt.Before(currentTime) {
+	// DynamoDB deletes expired items lazily, so an item can outlive its TTL
+	if time.Unix(cachedObject.ExpireAt, 0).Before(currentTime) {
 		return nil, nil
 	}
-	return cachedObject.cache, nil
+	if cachedObject.Mappings == nil {
+		// Empty maps are stored as NULL.  Nothing to sync is still a cached answer.
+		return map[TargetGroupARN]Mapping{}, nil
+	}
+	return cachedObject.Mappings, nil
 }
 
 var _ Storage = &DynamoDBStorage{}
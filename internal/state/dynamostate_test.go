@@ -0,0 +1,137 @@
+package state_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDynamoDB is a local DynamoDB stand-in that supports unconditional GetItem, PutItem, and DeleteItem for a table
+// keyed by "Key"
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+type fakeDynamoDBRequest struct {
+	Key  map[string]*dynamodb.AttributeValue
+	Item map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var in fakeDynamoDBRequest
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]interface{}{}
+	switch strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "GetItem":
+		if item, exists := f.items[*in.Key["Key"].S]; exists {
+			out["Item"] = item
+		}
+	case "PutItem":
+		f.items[*in.Item["Key"].S] = in.Item
+	case "DeleteItem":
+		delete(f.items, *in.Key["Key"].S)
+	default:
+		http.Error(rw, "unsupported operation", http.StatusBadRequest)
+		return
+	}
+	// The SDK structs have no omitempty tags, so drop the unset attribute value fields
+	b, err := json.Marshal(out)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	_ = json.NewEncoder(rw).Encode(stripNulls(generic))
+}
+
+func stripNulls(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			if elem != nil {
+				ret[k] = stripNulls(elem)
+			}
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, 0, len(val))
+		for _, elem := range val {
+			ret = append(ret, stripNulls(elem))
+		}
+		return ret
+	}
+	return v
+}
+
+func newFakeDynamoDBStorage(t *testing.T) (*state.DynamoDBStorage, *fakeDynamoDB) {
+	fake := &fakeDynamoDB{
+		items: make(map[string]map[string]*dynamodb.AttributeValue),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	ses, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	require.NoError(t, err)
+	return &state.DynamoDBStorage{
+		TableName:       "test",
+		Log:             testhelp.ZapTestingLogger(t),
+		Client:          dynamodb.New(ses),
+		SyncCachePrefix: "prefix",
+	}, fake
+}
+
+func TestDynamoDBStorageSyncCache(t *testing.T) {
+	st, fake := newFakeDynamoDBStorage(t)
+	testAnyStateCache(t, st)
+
+	expireAt := time.Now().Add(time.Minute)
+	require.NoError(t, st.StoreSync(context.Background(), map[state.TargetGroupARN]state.Mapping{
+		"arn:test": {Hostnames: []string{"a.example.com"}},
+	}, expireAt))
+	item := fake.items["synccache_prefix"]
+	require.NotNil(t, item["Mappings"].M["arn:test"], "mappings are stored as a map attribute")
+	require.Equal(t, aws.String(strconv.FormatInt(expireAt.Unix(), 10)), item["ExpireAt"].N, "ExpireAt can be the table's TTL attribute")
+}
+
+func TestDynamoDBStorageLegacySyncCache(t *testing.T) {
+	st, fake := newFakeDynamoDBStorage(t)
+	// Older versions never wrote the cached mappings, and stored ExpireAt as a string
+	fake.items["synccache_prefix"] = map[string]*dynamodb.AttributeValue{
+		"Key":      {S: aws.String("synccache_prefix")},
+		"ExpireAt": {S: aws.String(time.Now().Add(time.Hour).Format(time.RFC3339Nano))},
+	}
+	ret, err := st.GetSync(context.Background(), time.Now())
+	require.NoError(t, err)
+	require.Nil(t, ret)
+	require.NotContains(t, fake.items, "synccache_prefix")
+}
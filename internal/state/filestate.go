@@ -0,0 +1,199 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+)
+
+// FileStorage stores state and the tag sync cache in a local JSON file, so the syncer can run without DynamoDB.
+// Every read-modify-write holds an exclusive lock on Path + ".lock", and writes replace the file atomically, so
+// multiple processes can share one file.
+type FileStorage struct {
+	Path string
+	Log  *zapctx.Logger
+}
+
+type fileContents struct {
+	// States is keyed by Keys.String()
+	States    map[string]storageObject
+	SyncCache *fileSyncCache
+}
+
+type fileSyncCache struct {
+	ExpireAt time.Time
+	Mappings map[TargetGroupARN]Mapping
+}
+
+func (f *FileStorage) GetStates(ctx context.Context, syncPairs []Keys) (map[Keys]State, error) {
+	f.Log.Debug(ctx, "<- GetStates", zap.Any("pairs", syncPairs))
+	defer f.Log.Debug(ctx, "-> GetStates")
+	if len(syncPairs) == 0 {
+		return nil, nil
+	}
+	var contents *fileContents
+	err := f.withLock(func() error {
+		var err error
+		contents, err = f.load()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[Keys]State, len(syncPairs))
+	for _, sp := range syncPairs {
+		ret[sp] = contents.States[sp.String()].State
+	}
+	return ret, nil
+}
+
+func (f *FileStorage) Store(ctx context.Context, toStore map[Keys]State) error {
+	f.Log.Debug(ctx, "<- Store", zap.Any("pairs", toStore))
+	defer f.Log.Debug(ctx, "-> Store")
+	if len(toStore) == 0 {
+		return nil
+	}
+	return f.withLock(func() error {
+		contents, err := f.load()
+		if err != nil {
+			return err
+		}
+		var conflicts []Keys
+		for k, v := range toStore {
+			if contents.States[k.String()].State.Version != v.Version-1 {
+				conflicts = append(conflicts, k)
+				continue
+			}
+			if len(v.Targets) == 0 {
+				delete(contents.States, k.String())
+				continue
+			}
+			contents.States[k.String()] = storageObject{
+				Key:      k.String(),
+				TgARN:    string(k.TargetGroupARN),
+				Hostname: k.Hostnames,
+				State:    v,
+			}
+		}
+		if err := f.save(contents); err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return &VersionConflictError{Keys: conflicts}
+		}
+		return nil
+	})
+}
+
+func (f *FileStorage) StoreSync(_ context.Context, toStore map[TargetGroupARN]Mapping, expireAt time.Time) error {
+	return f.withLock(func() error {
+		contents, err := f.load()
+		if err != nil {
+			return err
+		}
+		contents.SyncCache = nil
+		if toStore != nil {
+			contents.SyncCache = &fileSyncCache{
+				ExpireAt: expireAt,
+				Mappings: toStore,
+			}
+		}
+		return f.save(contents)
+	})
+}
+
+func (f *FileStorage) GetSync(_ context.Context, currentTime time.Time) (map[TargetGroupARN]Mapping, error) {
+	var contents *fileContents
+	err := f.withLock(func() error {
+		var err error
+		contents, err = f.load()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if contents.SyncCache == nil || contents.SyncCache.ExpireAt.Before(currentTime) {
+		return nil, nil
+	}
+	return contents.SyncCache.Mappings, nil
+}
+
+func (f *FileStorage) withLock(fn func() error) error {
+	lock, err := os.OpenFile(f.Path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open lock file: %w", err)
+	}
+	defer func() {
+		f.Log.IfErr(lock.Close()).Warn(context.Background(), "unable to close lock file")
+	}()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("unable to lock %s: %w", lock.Name(), err)
+	}
+	defer func() {
+		f.Log.IfErr(unlockFile(lock)).Warn(context.Background(), "unable to unlock file")
+	}()
+	return fn()
+}
+
+func (f *FileStorage) load() (*fileContents, error) {
+	ret := &fileContents{
+		States: make(map[string]storageObject),
+	}
+	b, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", f.Path, err)
+	}
+	if err := json.Unmarshal(b, ret); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", f.Path, err)
+	}
+	if ret.States == nil {
+		ret.States = make(map[string]storageObject)
+	}
+	return ret, nil
+}
+
+// save writes to a temporary file in the same directory and renames it over Path, so readers never see a partial file
+func (f *FileStorage) save(contents *fileContents) error {
+	b, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("unable to create temp file: %w", err)
+	}
+	defer func() {
+		// Only fails if the rename already moved the file
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("unable to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("unable to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		return fmt.Errorf("unable to replace %s: %w", f.Path, err)
+	}
+	return nil
+}
+
+var _ Storage = &FileStorage{}
+
+var _ SyncCache = &FileStorage{}
@@ -0,0 +1,61 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	st := &state.FileStorage{
+		Path: filepath.Join(t.TempDir(), "state.json"),
+		Log:  testhelp.ZapTestingLogger(t),
+	}
+	testAnyStateStorage(t, st)
+	testAnyStateCache(t, st)
+}
+
+func TestFileStorageConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Separate instances stand in for separate processes
+			st := &state.FileStorage{
+				Path: path,
+				Log:  testhelp.ZapTestingLogger(t),
+			}
+			err := st.Store(ctx, map[state.Keys]state.State{
+				state.NewKeys(state.TargetGroupARN(fmt.Sprintf("arn:%d", i)), []string{"a.example.com"}): {
+					Targets: []state.Target{{IP: "1.2.3.4"}},
+					Version: 1,
+				},
+			})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	st := &state.FileStorage{
+		Path: path,
+		Log:  testhelp.ZapTestingLogger(t),
+	}
+	keys := make([]state.Keys, 0, 10)
+	for i := 0; i < 10; i++ {
+		keys = append(keys, state.NewKeys(state.TargetGroupARN(fmt.Sprintf("arn:%d", i)), []string{"a.example.com"}))
+	}
+	out, err := st.GetStates(ctx, keys)
+	require.NoError(t, err)
+	for _, k := range keys {
+		require.Equal(t, 1, out[k].Version, "missing %s", k)
+	}
+}
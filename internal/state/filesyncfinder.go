@@ -0,0 +1,139 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+	"sigs.k8s.io/yaml"
+)
+
+// configFile is the format of the file read by FileSyncFinder.  It is YAML, or JSON since JSON is valid YAML.
+type configFile struct {
+	Mappings []configFileMapping `json:"mappings"`
+}
+
+type configFileMapping struct {
+	TargetGroupARN                  string   `json:"targetGroupARN"`
+	Hostnames                       []string `json:"hostnames"`
+	Port                            int64    `json:"port"`
+	AvailabilityZone                string   `json:"availabilityZone"`
+	InvocationsBeforeDeregistration *int     `json:"invocationsBeforeDeregistration"`
+	RemoveUnknownTgIP               *bool    `json:"removeUnknownTgIP"`
+	MinTargets                      *int     `json:"minTargets"`
+	DNSServers                      []string `json:"dnsServers"`
+	Region                          string   `json:"region"`
+	RoleARN                         string   `json:"roleARN"`
+}
+
+func parseConfigFile(b []byte) (map[TargetGroupARN]Mapping, error) {
+	var cfg configFile
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config file: %w", err)
+	}
+	ret := make(map[TargetGroupARN]Mapping, len(cfg.Mappings))
+	for idx, m := range cfg.Mappings {
+		if m.TargetGroupARN == "" {
+			return nil, fmt.Errorf("mapping %d: no targetGroupARN", idx)
+		}
+		tgArn := TargetGroupARN(m.TargetGroupARN)
+		if _, exists := ret[tgArn]; exists {
+			return nil, fmt.Errorf("mapping %d: %s is mapped more than once", idx, tgArn)
+		}
+		mapping := Mapping{
+			Hostnames:                       ParseHostnames(strings.Join(m.Hostnames, ",")),
+			Port:                            m.Port,
+			AvailabilityZone:                m.AvailabilityZone,
+			MinTargets:                      m.MinTargets,
+			InvocationsBeforeDeregistration: m.InvocationsBeforeDeregistration,
+			RemoveUnknownTgIP:               m.RemoveUnknownTgIP,
+			DNSServers:                      m.DNSServers,
+			Location: Location{
+				Region:  m.Region,
+				RoleARN: m.RoleARN,
+			},
+		}
+		if len(mapping.Hostnames) == 0 {
+			return nil, fmt.Errorf("mapping %d: no hostnames for %s", idx, tgArn)
+		}
+		if mapping.Port < 0 || mapping.Port > 65535 {
+			return nil, fmt.Errorf("mapping %d: invalid port %d", idx, mapping.Port)
+		}
+		ret[tgArn] = mapping
+	}
+	return ret, nil
+}
+
+// FileSyncFinder syncs the mappings listed in a YAML or JSON file.  Call Load before ToSync.
+type FileSyncFinder struct {
+	Path string
+	Log  *zapctx.Logger
+	// Metrics is optional and records how many target groups were found
+	Metrics *metrics.Metrics
+
+	mappings map[TargetGroupARN]Mapping
+	contents []byte
+	mu       sync.Mutex
+}
+
+// Load reads the file if it changed since the last load.  If the file is invalid, the previous mappings are kept.
+func (f *FileSyncFinder) Load(ctx context.Context) error {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", f.Path, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mappings != nil && bytes.Equal(b, f.contents) {
+		return nil
+	}
+	mappings, err := parseConfigFile(b)
+	if err != nil {
+		return fmt.Errorf("unable to load %s: %w", f.Path, err)
+	}
+	f.Log.Info(ctx, "loaded config file", zap.String("path", f.Path), zap.Int("mappings", len(mappings)))
+	f.mappings = mappings
+	f.contents = b
+	f.Metrics.TagFinderResults(len(mappings))
+	return nil
+}
+
+// Watch reloads the file every interval, or whenever reload fires, until ctx is done
+func (f *FileSyncFinder) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case sig := <-reload:
+			f.Log.Info(ctx, "reloading config file", zap.Stringer("signal", sig))
+		}
+		if err := f.Load(ctx); err != nil {
+			f.Log.IfErr(err).Warn(ctx, "unable to reload config file: keeping previous mappings")
+		}
+	}
+}
+
+func (f *FileSyncFinder) ToSync(_ context.Context) (map[TargetGroupARN]Mapping, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mappings == nil {
+		return nil, fmt.Errorf("config file %s not loaded", f.Path)
+	}
+	ret := make(map[TargetGroupARN]Mapping, len(f.mappings))
+	for k, v := range f.mappings {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+var _ SyncFinder = &FileSyncFinder{}
@@ -0,0 +1,97 @@
+package state_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSyncFinder(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+mappings:
+  - targetGroupARN: arn:a
+    hostnames: [b.example.com, a.example.com]
+    port: 8443
+    availabilityZone: all
+    invocationsBeforeDeregistration: 5
+    removeUnknownTgIP: false
+    dnsServers: ["10.0.0.2"]
+  - targetGroupARN: arn:b
+    hostnames: [c.example.com]
+    region: eu-west-1
+    roleARN: arn:aws:iam::123456789012:role/sync
+`), 0600))
+	f := &state.FileSyncFinder{
+		Path: path,
+		Log:  testhelp.ZapTestingLogger(t),
+	}
+	_, err := f.ToSync(ctx)
+	require.Error(t, err, "not loaded yet")
+	require.NoError(t, f.Load(ctx))
+	toSync, err := f.ToSync(ctx)
+	require.NoError(t, err)
+	five := 5
+	no := false
+	require.Equal(t, map[state.TargetGroupARN]state.Mapping{
+		"arn:a": {
+			Hostnames:                       []string{"a.example.com", "b.example.com"},
+			Port:                            8443,
+			AvailabilityZone:                state.AvailabilityZoneAll,
+			InvocationsBeforeDeregistration: &five,
+			RemoveUnknownTgIP:               &no,
+			DNSServers:                      []string{"10.0.0.2"},
+		},
+		"arn:b": {
+			Hostnames: []string{"c.example.com"},
+			Location: state.Location{
+				Region:  "eu-west-1",
+				RoleARN: "arn:aws:iam::123456789012:role/sync",
+			},
+		},
+	}, toSync)
+
+	// An invalid file keeps the previous mappings
+	require.NoError(t, os.WriteFile(path, []byte(`mappings: [{targetGroupARN: arn:a, colour: blue}]`), 0600))
+	require.Error(t, f.Load(ctx))
+	toSync, err = f.ToSync(ctx)
+	require.NoError(t, err)
+	require.Len(t, toSync, 2)
+
+	// JSON works too
+	require.NoError(t, os.WriteFile(path, []byte(`{"mappings": [{"targetGroupARN": "arn:c", "hostnames": ["d.example.com"]}]}`), 0600))
+	reload := make(chan os.Signal, 1)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go f.Watch(watchCtx, time.Hour, reload)
+	reload <- syscall.SIGHUP
+	require.Eventually(t, func() bool {
+		toSync, err := f.ToSync(ctx)
+		return err == nil && len(toSync) == 1
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestFileSyncFinderInvalid(t *testing.T) {
+	for _, contents := range []string{
+		`mappings: [{hostnames: [a.example.com]}]`,
+		`mappings: [{targetGroupARN: arn:a}]`,
+		`mappings: [{targetGroupARN: arn:a, hostnames: [a.example.com], port: 70000}]`,
+		`mappings: [{targetGroupARN: arn:a, hostnames: [a.example.com]}, {targetGroupARN: arn:a, hostnames: [b.example.com]}]`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+		f := &state.FileSyncFinder{
+			Path: path,
+			Log:  testhelp.ZapTestingLogger(t),
+		}
+		require.Error(t, f.Load(context.Background()), contents)
+	}
+}
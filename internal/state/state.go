@@ -2,8 +2,13 @@ package state
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 type TargetGroupARN string
@@ -11,57 +16,231 @@ type TargetGroupARN string
 type Storage interface {
 	// GetStates returns a state result for each state key
 	GetStates(ctx context.Context, syncPairs []Keys) (map[Keys]State, error)
-	// Store results for all the state keys
+	// Store results for all the state keys.  A state is only stored if the stored version is one less than its
+	// version.  Conflicting states are skipped and returned as a *VersionConflictError.
 	Store(ctx context.Context, toStore map[Keys]State) error
 }
 
+// VersionConflictError is returned by Storage.Store when another writer changed some states after they were read
+type VersionConflictError struct {
+	Keys []Keys
+}
+
+func (v *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict storing %d states", len(v.Keys))
+}
+
 type Keys struct {
 	TargetGroupARN TargetGroupARN
-	Hostname       string
+	// Hostnames is the sorted, comma separated set of hostnames synced into the target group.  It is a string so
+	// Keys can stay a map key.
+	Hostnames string
+}
+
+// NewKeys creates a key for the set of hostnames synced into a target group.  The order of hostnames does not matter.
+func NewKeys(targetGroupARN TargetGroupARN, hostnames []string) Keys {
+	return Keys{
+		TargetGroupARN: targetGroupARN,
+		Hostnames:      strings.Join(normalizeHostnames(hostnames), ","),
+	}
+}
+
+// HostnameList returns the individual hostnames of this key
+func (k Keys) HostnameList() []string {
+	if k.Hostnames == "" {
+		return nil
+	}
+	return strings.Split(k.Hostnames, ",")
 }
 
 func (k Keys) String() string {
-	return string(k.TargetGroupARN) + " " + k.Hostname
+	return string(k.TargetGroupARN) + " " + k.Hostnames
+}
+
+// ParseHostnames splits a comma or space separated list of hostnames into a sorted set of hostnames.  Spaces are
+// accepted because AWS does not allow commas in tag values.
+func ParseHostnames(s string) []string {
+	return normalizeHostnames(splitFields(s))
+}
+
+func splitFields(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+func normalizeHostnames(hostnames []string) []string {
+	seen := make(map[string]struct{}, len(hostnames))
+	ret := make([]string, 0, len(hostnames))
+	for _, h := range hostnames {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if _, exists := seen[h]; exists {
+			continue
+		}
+		seen[h] = struct{}{}
+		ret = append(ret, h)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AvailabilityZoneAll registers IPs that are outside the target group's VPC
+const AvailabilityZoneAll = "all"
+
+// Location is the AWS account and region of a target group, and how to reach it.  The zero value is the account and
+// region of the default AWS session.
+type Location struct {
+	// Region of the target group.  Empty uses the default session's region.
+	Region string
+	// RoleARN to assume to manage the target group.  Its account is the target group's account.  Empty uses the default
+	// session's credentials.
+	RoleARN string
+}
+
+func (l Location) String() string {
+	if l == (Location{}) {
+		return "default"
+	}
+	if l.RoleARN == "" {
+		return l.Region
+	}
+	return l.RoleARN + "@" + l.Region
+}
+
+// ParseLocations parses a comma separated list of region=role-arn pairs.  The role is optional.
+func ParseLocations(s string) ([]Location, error) {
+	var ret []Location
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		loc := Location{
+			Region: strings.TrimSpace(parts[0]),
+		}
+		if len(parts) == 2 {
+			loc.RoleARN = strings.TrimSpace(parts[1])
+			if !strings.HasPrefix(loc.RoleARN, "arn:") {
+				return nil, fmt.Errorf("invalid role arn %s", loc.RoleARN)
+			}
+		}
+		if loc.Region == "" {
+			return nil, fmt.Errorf("no region in %s", field)
+		}
+		ret = append(ret, loc)
+	}
+	return ret, nil
+}
+
+// SRVPrefix marks a hostname as the name of SRV records, like "srv:_http._tcp.web.service.consul".  The targets of the
+// records are registered with the port of each record.
+const SRVPrefix = "srv:"
+
+// Mapping is what to sync into a single target group
+type Mapping struct {
+	// Hostnames to resolve.  Hostnames starting with SRVPrefix are resolved through SRV records.
+	Hostnames []string
+	// Port to register targets with.  Zero uses the target group's default port.
+	Port int64
+	// AvailabilityZone to register targets with.  Empty lets ELB pick from the target's subnet.
+	AvailabilityZone string
+	// MinTargets overrides the syncer's minimum target floor for this target group.  Nil uses the syncer's setting.
+	MinTargets *int
+	// InvocationsBeforeDeregistration overrides how many syncs a target must be missing before it is deregistered.  Nil
+	// uses the syncer's setting.
+	InvocationsBeforeDeregistration *int
+	// RemoveUnknownTgIP overrides whether targets that were never synced are removed.  Nil uses the syncer's setting.
+	RemoveUnknownTgIP *bool
+	// DNSServers to resolve Hostnames with.  Empty uses the syncer's resolver.
+	DNSServers []string
+	// Location of the target group.  The zero value uses the syncer's client.
+	Location Location
+}
+
+// HasSRV returns true if any hostname is resolved through SRV records
+func (m Mapping) HasSRV() bool {
+	for _, h := range m.Hostnames {
+		if strings.HasPrefix(h, SRVPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMapping parses a mapping from a tag value like "a.example.com b.example.com port=8443 az=all".
+// Hostnames are comma or space separated and options are key=value pairs.
+func ParseMapping(s string) (Mapping, error) {
+	var ret Mapping
+	var hostnames []string
+	for _, field := range splitFields(s) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 1 {
+			hostnames = append(hostnames, field)
+			continue
+		}
+		switch parts[0] {
+		case "port":
+			port, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || port < 1 || port > 65535 {
+				return Mapping{}, fmt.Errorf("invalid port %s", parts[1])
+			}
+			ret.Port = port
+		case "az":
+			ret.AvailabilityZone = parts[1]
+		default:
+			return Mapping{}, fmt.Errorf("unknown mapping option %s", parts[0])
+		}
+	}
+	ret.Hostnames = normalizeHostnames(hostnames)
+	if len(ret.Hostnames) == 0 {
+		return Mapping{}, fmt.Errorf("no hostnames in %s", s)
+	}
+	return ret, nil
 }
 
 type SyncFinder interface {
-	// Get the list of target groups -> hostname we should sync
-	ToSync(ctx context.Context) (map[TargetGroupARN]string, error)
+	// Get the list of target groups -> mapping we should sync
+	ToSync(ctx context.Context) (map[TargetGroupARN]Mapping, error)
 }
 
 type HardCodedSyncFinder struct {
 	TargetGroupARN TargetGroupARN
-	Hostname       string
+	Mapping        Mapping
 }
 
-func (h *HardCodedSyncFinder) ToSync(_ context.Context) (map[TargetGroupARN]string, error) {
-	return map[TargetGroupARN]string{
-		h.TargetGroupARN: h.Hostname,
+func (h *HardCodedSyncFinder) ToSync(_ context.Context) (map[TargetGroupARN]Mapping, error) {
+	return map[TargetGroupARN]Mapping{
+		h.TargetGroupARN: h.Mapping,
 	}, nil
 }
 
 var _ SyncFinder = &HardCodedSyncFinder{}
 
 type SyncCache interface {
-	StoreSync(ctx context.Context, toStore map[TargetGroupARN]string, expireAt time.Time) error
-	GetSync(ctx context.Context, currentTime time.Time) (map[TargetGroupARN]string, error)
+	StoreSync(ctx context.Context, toStore map[TargetGroupARN]Mapping, expireAt time.Time) error
+	GetSync(ctx context.Context, currentTime time.Time) (map[TargetGroupARN]Mapping, error)
 }
 
 type LocalSyncCache struct {
-	store    map[TargetGroupARN]string
+	store    map[TargetGroupARN]Mapping
 	expireAt time.Time
 	mu       sync.Mutex
 }
 
-func (l *LocalSyncCache) copyStore() map[TargetGroupARN]string {
-	ret := make(map[TargetGroupARN]string, len(l.store))
+func (l *LocalSyncCache) copyStore() map[TargetGroupARN]Mapping {
+	ret := make(map[TargetGroupARN]Mapping, len(l.store))
 	for k, v := range l.store {
+		v.Hostnames = append([]string(nil), v.Hostnames...)
 		ret[k] = v
 	}
 	return ret
 }
 
-func (l *LocalSyncCache) StoreSync(_ context.Context, toStore map[TargetGroupARN]string, expireAt time.Time) error {
+func (l *LocalSyncCache) StoreSync(_ context.Context, toStore map[TargetGroupARN]Mapping, expireAt time.Time) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	l.store = toStore
@@ -70,7 +249,7 @@ func (l *LocalSyncCache) StoreSync(_ context.Context, toStore map[TargetGroupARN
 	return nil
 }
 
-func (l *LocalSyncCache) GetSync(_ context.Context, currentTime time.Time) (map[TargetGroupARN]string, error) {
+func (l *LocalSyncCache) GetSync(_ context.Context, currentTime time.Time) (map[TargetGroupARN]Mapping, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	if currentTime.After(l.expireAt) {
@@ -82,11 +261,22 @@ func (l *LocalSyncCache) GetSync(_ context.Context, currentTime time.Time) (map[
 var _ SyncCache = &LocalSyncCache{}
 
 type Target struct {
-	IP           string
-	TimesMissing int
+	IP string
+	// Port the target is registered with.  Zero means the target group's default port.
+	Port int64
+	// AvailabilityZone the target is registered with, if one was set
+	AvailabilityZone string
+	TimesMissing     int
+	// Health is the target's ELB health state as of the last sync.  Empty if the target was not registered.
+	Health string
+	// TimesUnhealthy counts syncs in a row the target was unhealthy, or out of the target group for being unhealthy
+	TimesUnhealthy int
 }
 
 type State struct {
 	Targets []Target
 	Version int
+	// CanonicalNames are the names the hostnames' CNAME chains ended at as of the last sync, by hostname.  Hostnames
+	// that are not a CNAME are absent.
+	CanonicalNames map[string]string
 }
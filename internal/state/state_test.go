@@ -0,0 +1,63 @@
+package state_test
+
+import (
+	"testing"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMapping(t *testing.T) {
+	m, err := state.ParseMapping("b.example.com a.example.com port=8443 az=all")
+	require.NoError(t, err)
+	require.Equal(t, state.Mapping{
+		Hostnames:        []string{"a.example.com", "b.example.com"},
+		Port:             8443,
+		AvailabilityZone: state.AvailabilityZoneAll,
+	}, m)
+
+	m, err = state.ParseMapping("a.example.com,a.example.com")
+	require.NoError(t, err)
+	require.Equal(t, state.Mapping{Hostnames: []string{"a.example.com"}}, m)
+
+	_, err = state.ParseMapping("a.example.com min-targets=1")
+	require.Error(t, err, "min-targets is its own tag")
+	_, err = state.ParseMapping("a.example.com port=abc")
+	require.Error(t, err)
+	_, err = state.ParseMapping("a.example.com color=blue")
+	require.Error(t, err)
+	_, err = state.ParseMapping("port=80")
+	require.Error(t, err)
+
+	m, err = state.ParseMapping("srv:_http._tcp.web.example.com a.example.com port=80")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.example.com", "srv:_http._tcp.web.example.com"}, m.Hostnames)
+	require.True(t, m.HasSRV())
+	require.False(t, state.Mapping{Hostnames: []string{"a.example.com"}}.HasSRV())
+}
+
+func TestNewKeys(t *testing.T) {
+	k := state.NewKeys("arn:test", []string{"b.example.com", "a.example.com"})
+	require.Equal(t, state.NewKeys("arn:test", []string{"a.example.com", "b.example.com"}), k)
+	require.Equal(t, "arn:test a.example.com,b.example.com", k.String())
+	require.Equal(t, []string{"a.example.com", "b.example.com"}, k.HostnameList())
+}
+
+func TestParseLocations(t *testing.T) {
+	locs, err := state.ParseLocations("us-west-2, eu-west-1=arn:aws:iam::123456789012:role/sync,")
+	require.NoError(t, err)
+	require.Equal(t, []state.Location{
+		{Region: "us-west-2"},
+		{Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/sync"},
+	}, locs)
+	require.Equal(t, "arn:aws:iam::123456789012:role/sync@eu-west-1", locs[1].String())
+
+	locs, err = state.ParseLocations("")
+	require.NoError(t, err)
+	require.Empty(t, locs)
+
+	_, err = state.ParseLocations("=arn:aws:iam::123456789012:role/sync")
+	require.Error(t, err)
+	_, err = state.ParseLocations("us-west-2=sync")
+	require.Error(t, err)
+}
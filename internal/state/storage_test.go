@@ -0,0 +1,112 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/stretchr/testify/require"
+)
+
+func testAnyStateCache(t *testing.T, store state.SyncCache) {
+	ctx := context.Background()
+	prev, err := store.GetSync(ctx, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, prev)
+	now := time.Now()
+	toCache := map[state.TargetGroupARN]state.Mapping{
+		"arn:test": {
+			Hostnames: []string{"a.example.com", "b.example.com"},
+			Port:      8443,
+		},
+	}
+	err = store.StoreSync(ctx, toCache, now.Add(time.Minute))
+	require.NoError(t, err)
+	prev, err = store.GetSync(ctx, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, toCache, prev)
+
+	prev, err = store.GetSync(ctx, now.Add(time.Second*61))
+	require.NoError(t, err)
+	require.Nil(t, prev)
+
+	// Finding nothing to sync is still worth caching
+	err = store.StoreSync(ctx, map[state.TargetGroupARN]state.Mapping{}, now.Add(time.Minute))
+	require.NoError(t, err)
+	prev, err = store.GetSync(ctx, now.Add(time.Second))
+	require.NoError(t, err)
+	require.NotNil(t, prev)
+	require.Empty(t, prev)
+
+	err = store.StoreSync(ctx, nil, now.Add(time.Minute))
+	require.NoError(t, err)
+	prev, err = store.GetSync(ctx, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Nil(t, prev)
+}
+
+func testAnyStateStorage(t *testing.T, store state.Storage) {
+	ctx := context.Background()
+	testName := fmt.Sprintf("TestStateStorage:%s", time.Now())
+	sk := state.NewKeys(state.TargetGroupARN(testName), []string{"www.google.com", "www.example.com"})
+	// States should start missing
+	out, err := store.GetStates(ctx, []state.Keys{sk})
+	require.NoError(t, err)
+	require.Empty(t, out[sk])
+	storedStates := []state.Target{
+		{
+			IP:           "1.2.3.4",
+			Port:         8443,
+			TimesMissing: 0,
+		}, {
+			IP:           "1.2.3.5",
+			TimesMissing: 3,
+		},
+	}
+	// Should be able to add a state
+	err = store.Store(ctx, map[state.Keys]state.State{
+		sk: {
+			Targets:        storedStates,
+			Version:        1,
+			CanonicalNames: map[string]string{"www.example.com": "lb.example.com"},
+		},
+	})
+	require.NoError(t, err)
+
+	// Should see the state when you fetch it out
+	out, err = store.GetStates(ctx, []state.Keys{sk})
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+
+	require.NotEmpty(t, out[sk])
+	require.Equal(t, 1, out[sk].Version)
+	require.Len(t, out[sk].Targets, 2)
+	require.Equal(t, storedStates, out[sk].Targets)
+	require.Equal(t, map[string]string{"www.example.com": "lb.example.com"}, out[sk].CanonicalNames)
+
+	// A write derived from an old version should conflict
+	err = store.Store(ctx, map[state.Keys]state.State{
+		sk: {
+			Targets: storedStates[:1],
+			Version: 1,
+		},
+	})
+	var conflictErr *state.VersionConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	require.Equal(t, []state.Keys{sk}, conflictErr.Keys)
+
+	// Now remove the item
+	err = store.Store(ctx, map[state.Keys]state.State{
+		sk: {
+			Version: 2,
+		},
+	})
+	require.NoError(t, err)
+
+	// And expect it gone
+	out, err = store.GetStates(ctx, []state.Keys{sk})
+	require.NoError(t, err)
+	require.Empty(t, out[sk])
+}
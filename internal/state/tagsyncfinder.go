@@ -3,47 +3,119 @@ package state
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
 	"github.com/cresta/zapctx"
 	"go.uber.org/zap"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
 )
 
 type TagSyncFinder struct {
-	Client *resourcegroupstaggingapi.ResourceGroupsTaggingAPI
-	TagKey string
-	Log    *zapctx.Logger
+	Client resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	// Locations are other accounts and regions to also search, with the client for each.  Target groups found there
+	// are synced with that location.
+	Locations map[Location]resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	TagKey    string
+	Log       *zapctx.Logger
+	// Metrics is optional and records how many target groups were found
+	Metrics *metrics.Metrics
 }
 
-func (t *TagSyncFinder) ToSync(ctx context.Context) (map[TargetGroupARN]string, error) {
+func (t *TagSyncFinder) ToSync(ctx context.Context) (map[TargetGroupARN]Mapping, error) {
 	t.Log.Debug(ctx, "<- ToSync")
 	defer t.Log.Debug(ctx, "-> ToSync")
-	res := make(map[TargetGroupARN]string, 10)
-	err := t.Client.GetResourcesPagesWithContext(ctx, &resourcegroupstaggingapi.GetResourcesInput{
+	res := make(map[TargetGroupARN]Mapping, 10)
+	if err := t.search(ctx, t.Client, Location{}, res); err != nil {
+		return nil, err
+	}
+	locations := make([]Location, 0, len(t.Locations))
+	for loc := range t.Locations {
+		locations = append(locations, loc)
+	}
+	// Search in a stable order, so the same location wins a target group found more than once
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].String() < locations[j].String()
+	})
+	for _, loc := range locations {
+		if err := t.search(ctx, t.Locations[loc], loc, res); err != nil {
+			return nil, fmt.Errorf("unable to search %s: %w", loc, err)
+		}
+	}
+	t.Log.Debug(ctx, "found arn to sync", zap.Any("arn", res))
+	t.Metrics.TagFinderResults(len(res))
+	return res, nil
+}
+
+// search adds the tagged target groups client can see to res
+func (t *TagSyncFinder) search(ctx context.Context, client resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI, location Location, res map[TargetGroupARN]Mapping) error {
+	err := client.GetResourcesPagesWithContext(ctx, &resourcegroupstaggingapi.GetResourcesInput{
 		TagFilters: []*resourcegroupstaggingapi.TagFilter{
 			{
 				Key: &t.TagKey,
 			},
 		},
 	}, func(output *resourcegroupstaggingapi.GetResourcesOutput, b bool) bool {
-	outer:
 		for _, m := range output.ResourceTagMappingList {
-			for _, tag := range m.Tags {
-				if *tag.Key == t.TagKey {
-					res[TargetGroupARN(*m.ResourceARN)] = *tag.Value
-					continue outer
-				}
+			tgArn := TargetGroupARN(*m.ResourceARN)
+			if existing, exists := res[tgArn]; exists {
+				t.Log.Warn(ctx, "target group found more than once: skipping", zap.String("arn", string(tgArn)), zap.Stringer("location", location), zap.Stringer("found_in", existing.Location))
+				continue
 			}
+			mapping, err := t.mappingFromTags(m.Tags)
+			if err != nil {
+				t.Log.IfErr(err).Warn(ctx, "unable to parse tags: skipping target group", zap.String("arn", string(tgArn)))
+				continue
+			}
+			mapping.Location = location
+			res[tgArn] = mapping
 		}
 		return true
 	})
 	if err != nil {
-		return nil, fmt.Errorf("uanble to page results: %w", err)
+		return fmt.Errorf("uanble to page results: %w", err)
 	}
-	t.Log.Debug(ctx, "found arn to sync", zap.Any("arn", res))
-	return res, nil
+	return nil
+}
+
+// mappingFromTags parses the TagKey tag, and the optional "<TagKey>/invocations-before-deregistration",
+// "<TagKey>/remove-unknown", and "<TagKey>/min-targets" tags that override the syncer's settings for this target group
+func (t *TagSyncFinder) mappingFromTags(tags []*resourcegroupstaggingapi.Tag) (Mapping, error) {
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		values[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	mapping, err := ParseMapping(values[t.TagKey])
+	if err != nil {
+		return Mapping{}, fmt.Errorf("unable to parse tag value %s: %w", values[t.TagKey], err)
+	}
+	if v, exists := values[t.TagKey+"/invocations-before-deregistration"]; exists {
+		invocations, err := strconv.Atoi(v)
+		if err != nil || invocations < 0 {
+			return Mapping{}, fmt.Errorf("invalid invocations-before-deregistration %s", v)
+		}
+		mapping.InvocationsBeforeDeregistration = &invocations
+	}
+	if v, exists := values[t.TagKey+"/remove-unknown"]; exists {
+		removeUnknown, err := strconv.ParseBool(v)
+		if err != nil {
+			return Mapping{}, fmt.Errorf("invalid remove-unknown %s: %w", v, err)
+		}
+		mapping.RemoveUnknownTgIP = &removeUnknown
+	}
+	if v, exists := values[t.TagKey+"/min-targets"]; exists {
+		minTargets, err := strconv.Atoi(v)
+		if err != nil || minTargets < 0 {
+			return Mapping{}, fmt.Errorf("invalid min-targets %s", v)
+		}
+		mapping.MinTargets = &minTargets
+	}
+	return mapping, nil
 }
 
 var _ SyncFinder = &TagSyncFinder{}
@@ -55,7 +127,7 @@ type CachedSyncer struct {
 	CacheDuration time.Duration
 }
 
-func (c *CachedSyncer) ToSync(ctx context.Context) (map[TargetGroupARN]string, error) {
+func (c *CachedSyncer) ToSync(ctx context.Context) (map[TargetGroupARN]Mapping, error) {
 	now := time.Now()
 	cachedRes, err := c.SyncCache.GetSync(ctx, now)
 	if err != nil {
@@ -16,12 +16,14 @@ import (
 
 func TestTagSyncFinder(t *testing.T) {
 	if os.Getenv("TAG_KEY") == "" || os.Getenv("ARN_PAIRS") == "" {
-		t.Skip("skipping test: expect env TAG_KEY=<tag_key> and ARN_PAIRS=<arn>=<hostname>,<arn>=<hostname>...")
+		t.Skip("skipping test: expect env TAG_KEY=<tag_key> and ARN_PAIRS=<arn>=<hostname> <hostname>,<arn>=<hostname>...")
 	}
-	expectedMap := make(map[state.TargetGroupARN]string)
+	expectedMap := make(map[state.TargetGroupARN]state.Mapping)
 	for _, part := range strings.Split(os.Getenv("ARN_PAIRS"), ",") {
 		p2 := strings.SplitN(part, "=", 2)
-		expectedMap[state.TargetGroupARN(p2[0])] = p2[1]
+		mapping, err := state.ParseMapping(p2[1])
+		require.NoError(t, err)
+		expectedMap[state.TargetGroupARN(p2[0])] = mapping
 	}
 	ses, err := session.NewSession()
 	require.NoError(t, err)
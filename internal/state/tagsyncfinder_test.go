@@ -0,0 +1,99 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTagging returns its tagged resources, by ARN, in a single page
+type fakeTagging struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	resources map[string]string
+}
+
+func (f *fakeTagging) GetResourcesPagesWithContext(_ aws.Context, in *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool, _ ...request.Option) error {
+	out := &resourcegroupstaggingapi.GetResourcesOutput{}
+	for arn, value := range f.resources {
+		out.ResourceTagMappingList = append(out.ResourceTagMappingList, &resourcegroupstaggingapi.ResourceTagMapping{
+			ResourceARN: aws.String(arn),
+			Tags: []*resourcegroupstaggingapi.Tag{
+				{Key: in.TagFilters[0].Key, Value: aws.String(value)},
+			},
+		})
+	}
+	fn(out, true)
+	return nil
+}
+
+func TestTagSyncFinderLocations(t *testing.T) {
+	remote := Location{Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/sync"}
+	finder := &TagSyncFinder{
+		Client: &fakeTagging{resources: map[string]string{
+			"arn:local": "a.example.com",
+		}},
+		Locations: map[Location]resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI{
+			remote: &fakeTagging{resources: map[string]string{
+				"arn:remote": "b.example.com",
+				"arn:local":  "c.example.com",
+			}},
+		},
+		TagKey: "hostname",
+		Log:    testhelp.ZapTestingLogger(t),
+	}
+	toSync, err := finder.ToSync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[TargetGroupARN]Mapping{
+		"arn:local":  {Hostnames: []string{"a.example.com"}},
+		"arn:remote": {Hostnames: []string{"b.example.com"}, Location: remote},
+	}, toSync)
+}
+
+func TestTagSyncFinderMappingFromTags(t *testing.T) {
+	finder := &TagSyncFinder{TagKey: "hostname"}
+	tags := func(kv ...string) []*resourcegroupstaggingapi.Tag {
+		ret := make([]*resourcegroupstaggingapi.Tag, 0, len(kv)/2)
+		for i := 0; i < len(kv); i += 2 {
+			ret = append(ret, &resourcegroupstaggingapi.Tag{Key: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+		}
+		return ret
+	}
+
+	mapping, err := finder.mappingFromTags(tags("hostname", "a.example.com", "other", "x"))
+	require.NoError(t, err)
+	require.Equal(t, Mapping{Hostnames: []string{"a.example.com"}}, mapping)
+
+	mapping, err = finder.mappingFromTags(tags(
+		"hostname", "a.example.com",
+		"hostname/invocations-before-deregistration", "10",
+		"hostname/remove-unknown", "false",
+		"hostname/min-targets", "0",
+	))
+	require.NoError(t, err)
+	ten := 10
+	no := false
+	zero := 0
+	require.Equal(t, Mapping{
+		Hostnames:                       []string{"a.example.com"},
+		InvocationsBeforeDeregistration: &ten,
+		RemoveUnknownTgIP:               &no,
+		MinTargets:                      &zero,
+	}, mapping)
+
+	for _, invalid := range [][]*resourcegroupstaggingapi.Tag{
+		tags("hostname", ""),
+		tags("hostname", "a.example.com", "hostname/invocations-before-deregistration", "-1"),
+		tags("hostname", "a.example.com", "hostname/invocations-before-deregistration", "many"),
+		tags("hostname", "a.example.com", "hostname/remove-unknown", "maybe"),
+		tags("hostname", "a.example.com", "hostname/min-targets", "-1"),
+	} {
+		_, err := finder.mappingFromTags(invalid)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,88 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/audit"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"go.uber.org/zap"
+)
+
+const (
+	reasonNewInDNS             = "new in DNS"
+	reasonUnknown              = "unknown"
+	reasonUnhealthyRetry       = "retry after unhealthy"
+	reasonCanonicalNameChanged = "CNAME target changed"
+)
+
+// changeReasons says why each target is added or removed.  deregisterImmediately attributes targets missing from DNS to
+// a hostname's CNAME chain ending somewhere new, which removed them before their usual number of misses.
+func (s *Syncer) changeReasons(previousResult state.State, newState state.State, toAdd []string, toRemove []string, deregisterImmediately bool) map[string]string {
+	previous := make(map[string]state.Target, len(previousResult.Targets))
+	for _, t := range previousResult.Targets {
+		previous[TargetKey(t.IP, t.Port)] = t
+	}
+	tracked := make(map[string]state.Target, len(newState.Targets))
+	for _, t := range newState.Targets {
+		tracked[TargetKey(t.IP, t.Port)] = t
+	}
+	limit := s.Config.UnhealthyInvocationsBeforeDeregistration
+	ret := make(map[string]string, len(toAdd)+len(toRemove))
+	for _, key := range toAdd {
+		if limit > 0 && previous[key].TimesUnhealthy >= limit {
+			ret[key] = reasonUnhealthyRetry
+		} else {
+			ret[key] = reasonNewInDNS
+		}
+	}
+	for _, key := range toRemove {
+		// Only targets removed for their health are still tracked
+		if t, exists := tracked[key]; exists && t.TimesUnhealthy > 0 {
+			ret[key] = fmt.Sprintf("unhealthy %d times", t.TimesUnhealthy)
+		} else if _, exists := previous[key]; exists && deregisterImmediately {
+			ret[key] = reasonCanonicalNameChanged
+		} else if t, exists := previous[key]; exists {
+			ret[key] = fmt.Sprintf("missed %d times", t.TimesMissing+1)
+		} else {
+			ret[key] = reasonUnknown
+		}
+	}
+	return ret
+}
+
+// recordAudit records targets changed by a sync to Syncer.Audit, with one event per reason
+func (s *Syncer) recordAudit(ctx context.Context, targetGroupARN state.TargetGroupARN, plan *Plan, action string, targets []string) {
+	if s.Audit == nil || len(targets) == 0 {
+		return
+	}
+	byReason := make(map[string][]string)
+	for _, key := range targets {
+		byReason[plan.Reasons[key]] = append(byReason[plan.Reasons[key]], key)
+	}
+	reasons := make([]string, 0, len(byReason))
+	for reason := range byReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	now := time.Now()
+	events := make([]audit.Event, 0, len(reasons))
+	for _, reason := range reasons {
+		events = append(events, audit.Event{
+			Time:           now,
+			Action:         action,
+			TargetGroupARN: string(targetGroupARN),
+			Hostnames:      plan.Hostnames,
+			Targets:        byReason[reason],
+			Reason:         reason,
+			Resolvers:      plan.Resolvers,
+			CNAMEChains:    plan.CNAMEChains,
+			StateVersion:   plan.NewState.Version,
+		})
+	}
+	if err := s.Audit.Record(ctx, events); err != nil {
+		s.Log.IfErr(err).Warn(ctx, "unable to record audit events", zap.String("targetgroup_arn", string(targetGroupARN)), zap.String("action", action))
+	}
+}
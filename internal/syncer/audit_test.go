@@ -0,0 +1,102 @@
+package syncer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cresta/hostname-for-target-group/internal/audit"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	events []audit.Event
+	mu     sync.Mutex
+}
+
+func (r *recordingSink) Record(_ context.Context, events []audit.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func TestSyncSingleAudit(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+			{Id: aws.String("1.2.3.7")},
+			{Id: aws.String("9.9.9.9")},
+		},
+		health: map[string]string{
+			"1.2.3.7": elbv2.TargetHealthStateEnumUnhealthy,
+		},
+	}
+	sink := &recordingSink{}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration:          2,
+			RemoveUnknownTgIP:                        true,
+			UnhealthyInvocationsBeforeDeregistration: 1,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4", "1.2.3.6", "1.2.3.7"),
+		},
+		Audit: sink,
+	}
+	previous := state.State{
+		Version: 4,
+		Targets: []state.Target{
+			{IP: "1.2.3.4"},
+			{IP: "1.2.3.5", TimesMissing: 1},
+			{IP: "1.2.3.7"},
+		},
+	}
+	mapping := state.Mapping{Hostnames: []string{"a.example.com"}}
+	plan, err := s.syncSingle(context.Background(), "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"1.2.3.5": "missed 2 times",
+		"1.2.3.6": reasonNewInDNS,
+		"1.2.3.7": "unhealthy 1 times",
+		"9.9.9.9": reasonUnknown,
+	}, plan.Reasons)
+	require.Len(t, sink.events, 4)
+	for i := range sink.events {
+		require.False(t, sink.events[i].Time.IsZero())
+		sink.events[i].Time = time.Time{}
+	}
+	base := audit.Event{
+		TargetGroupARN: "arn:test",
+		Hostnames:      []string{"a.example.com"},
+		StateVersion:   5,
+	}
+	event := func(action string, reason string, targets ...string) audit.Event {
+		ret := base
+		ret.Action = action
+		ret.Reason = reason
+		ret.Targets = targets
+		return ret
+	}
+	require.Equal(t, []audit.Event{
+		event(audit.ActionRegister, reasonNewInDNS, "1.2.3.6"),
+		event(audit.ActionDeregister, "missed 2 times", "1.2.3.5"),
+		event(audit.ActionDeregister, "unhealthy 1 times", "1.2.3.7"),
+		event(audit.ActionDeregister, reasonUnknown, "9.9.9.9"),
+	}, sink.events)
+
+	// Dry runs record nothing
+	sink.events = nil
+	s.Config.DryRun = true
+	_, err = s.syncSingle(context.Background(), "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Empty(t, sink.events)
+}
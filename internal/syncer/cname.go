@@ -0,0 +1,61 @@
+package syncer
+
+import "sort"
+
+// CanonicalNameChange is a hostname whose CNAME chain ends somewhere new, which usually means its backend, like a
+// load balancer or database, was replaced
+type CanonicalNameChange struct {
+	Hostname string
+	Previous string
+	// Current is empty if the hostname is no longer a CNAME
+	Current string
+}
+
+// canonicalNamesOf returns the last name of each CNAME chain, by hostname
+func canonicalNamesOf(chains map[string][]string) map[string]string {
+	if len(chains) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(chains))
+	for hostname, chain := range chains {
+		if len(chain) > 0 {
+			ret[hostname] = chain[len(chain)-1]
+		}
+	}
+	return ret
+}
+
+// keepCanonicalNames returns current with the previous canonical name of each unknown hostname, whose CNAME chain the
+// resolver could not look up.  Their CNAME is not known to have changed.
+func keepCanonicalNames(previous map[string]string, current map[string]string, unknown []string) map[string]string {
+	for _, hostname := range unknown {
+		prev, exists := previous[hostname]
+		if !exists {
+			continue
+		}
+		if current == nil {
+			current = make(map[string]string, len(unknown))
+		}
+		current[hostname] = prev
+	}
+	return current
+}
+
+// diffCanonicalNames returns the hostnames whose canonical name changed, sorted by hostname.  A hostname with no
+// previous canonical name is not a change: it may be new, or its state may predate canonical names.
+func diffCanonicalNames(previous map[string]string, current map[string]string) []CanonicalNameChange {
+	var ret []CanonicalNameChange
+	for hostname, prev := range previous {
+		if prev != "" && current[hostname] != prev {
+			ret = append(ret, CanonicalNameChange{
+				Hostname: hostname,
+				Previous: prev,
+				Current:  current[hostname],
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Hostname < ret[j].Hostname
+	})
+	return ret
+}
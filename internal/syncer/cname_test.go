@@ -0,0 +1,158 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCNAMEChain(t *testing.T) {
+	answer := []dns.RR{
+		mustRR(t, "www.example.com. 300 IN CNAME Edge.example.com."),
+		mustRR(t, "edge.example.com. 300 IN CNAME my-lb-123.us-west-2.elb.amazonaws.com."),
+		mustRR(t, "my-lb-123.us-west-2.elb.amazonaws.com. 60 IN A 10.0.0.1"),
+	}
+	require.Equal(t, []string{"edge.example.com", "my-lb-123.us-west-2.elb.amazonaws.com"}, cnameChain("WWW.example.com", answer))
+	require.Empty(t, cnameChain("other.example.com", answer))
+
+	looping := []dns.RR{
+		mustRR(t, "a.example.com. 300 IN CNAME b.example.com."),
+		mustRR(t, "b.example.com. 300 IN CNAME a.example.com."),
+	}
+	require.Equal(t, []string{"b.example.com", "a.example.com"}, cnameChain("a.example.com", looping))
+}
+
+func TestDiffCanonicalNames(t *testing.T) {
+	require.Empty(t, diffCanonicalNames(nil, map[string]string{"a.example.com": "lb-1.example.com"}), "no previous name is not a change")
+	require.Empty(t, diffCanonicalNames(map[string]string{"a.example.com": "lb-1.example.com"}, map[string]string{"a.example.com": "lb-1.example.com"}))
+	require.Equal(t, []CanonicalNameChange{
+		{Hostname: "a.example.com", Previous: "lb-1.example.com", Current: "lb-2.example.com"},
+		{Hostname: "b.example.com", Previous: "db-1.example.com"},
+	}, diffCanonicalNames(map[string]string{
+		"b.example.com": "db-1.example.com",
+		"a.example.com": "lb-1.example.com",
+	}, map[string]string{
+		"a.example.com": "lb-2.example.com",
+	}))
+	require.Equal(t, map[string]string{"a.example.com": "lb-2.example.com"}, canonicalNamesOf(map[string][]string{
+		"a.example.com": {"edge.example.com", "lb-2.example.com"},
+	}))
+	require.Nil(t, canonicalNamesOf(nil))
+
+	previous := map[string]string{"a.example.com": "lb-1.example.com"}
+	require.Equal(t, previous, keepCanonicalNames(previous, nil, []string{"a.example.com"}), "an unknown chain keeps its canonical name")
+	require.Empty(t, diffCanonicalNames(previous, keepCanonicalNames(previous, nil, []string{"a.example.com"})))
+	require.Nil(t, keepCanonicalNames(previous, nil, []string{"b.example.com"}))
+	require.True(t, combineAnswers(QuorumFirst, []*Answer{{ChainUnknown: true}}).ChainUnknown)
+	require.False(t, combineAnswers(QuorumFirst, []*Answer{{ChainUnknown: true}, {}}).ChainUnknown, "one answer knowing the chain is enough")
+}
+
+func TestSyncSingleCNAMEChange(t *testing.T) {
+	oldLB := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.example.com. 300 IN CNAME lb-old.example.com."),
+			mustRR(t, "lb-old.example.com. 60 IN A 10.0.0.1"),
+		},
+	})
+	newLB := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.example.com. 300 IN CNAME lb-new.example.com."),
+			mustRR(t, "lb-new.example.com. 60 IN A 10.0.0.2"),
+		},
+	})
+	ctx := context.Background()
+	mapping := state.Mapping{Hostnames: []string{"www.example.com"}}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: &fakeELB{},
+		Config: Config{
+			InvocationsBeforeDeregistration: 3,
+		},
+		Audit: &recordingSink{},
+	}
+	var err error
+	s.Resolver, err = NewMultiResolver(testhelp.ZapTestingLogger(t), []string{oldLB}, ServerOptions{})
+	require.NoError(t, err)
+	plan, err := s.syncSingle(ctx, "arn:test", mapping, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, plan.ToAdd)
+	require.Equal(t, map[string][]string{"www.example.com": {"lb-old.example.com"}}, plan.CNAMEChains)
+	require.Equal(t, map[string]string{"www.example.com": "lb-old.example.com"}, plan.NewState.CanonicalNames)
+	require.Empty(t, plan.CanonicalNameChanges)
+	previous := plan.NewState
+
+	// The load balancer is replaced
+	s.Resolver, err = NewMultiResolver(testhelp.ZapTestingLogger(t), []string{newLB}, ServerOptions{})
+	require.NoError(t, err)
+	registered := []*elbv2.TargetDescription{{Id: aws.String("10.0.0.1")}}
+	s.Client = &fakeELB{targets: registered}
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Equal(t, []CanonicalNameChange{
+		{Hostname: "www.example.com", Previous: "lb-old.example.com", Current: "lb-new.example.com"},
+	}, plan.CanonicalNameChanges)
+	require.Equal(t, []string{"10.0.0.2"}, plan.ToAdd)
+	require.Empty(t, plan.ToRemove, "without DeregisterOnCanonicalNameChange the old targets wait out the threshold")
+	require.Equal(t, 3, plan.InvocationsBeforeDeregistration)
+	require.False(t, plan.DeregisterImmediately)
+	require.Equal(t, map[string]string{"www.example.com": "lb-new.example.com"}, plan.NewState.CanonicalNames)
+
+	// A target removed after its usual misses is not blamed on the CNAME change
+	missedTwice := previous
+	missedTwice.Targets = []state.Target{{IP: "10.0.0.1", TimesMissing: 2}}
+	s.Client = &fakeELB{targets: registered}
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, missedTwice)
+	require.NoError(t, err)
+	require.Len(t, plan.CanonicalNameChanges, 1)
+	require.Equal(t, []string{"10.0.0.1"}, plan.ToRemove)
+	require.Equal(t, "missed 3 times", plan.Reasons["10.0.0.1"])
+
+	s.Config.DeregisterOnCanonicalNameChange = true
+	sink := &recordingSink{}
+	s.Audit = sink
+	s.Client = &fakeELB{targets: registered}
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, plan.ToRemove)
+	require.Equal(t, 1, plan.InvocationsBeforeDeregistration)
+	require.True(t, plan.DeregisterImmediately)
+	require.Equal(t, reasonCanonicalNameChanged, plan.Reasons["10.0.0.1"])
+	require.Len(t, sink.events, 2)
+	require.Equal(t, map[string][]string{"www.example.com": {"lb-new.example.com"}}, sink.events[1].CNAMEChains)
+	require.Equal(t, reasonCanonicalNameChanged, sink.events[1].Reason)
+
+	// Other hostnames' missing targets are not deregistered at once
+	s.Resolver, err = NewMultiResolver(testhelp.ZapTestingLogger(t), []string{newLB}, ServerOptions{})
+	require.NoError(t, err)
+	s.Client = &fakeELB{targets: registered}
+	plan, err = s.syncSingle(ctx, "arn:test", state.Mapping{Hostnames: []string{"www.example.com", "lb-new.example.com"}}, previous)
+	require.NoError(t, err)
+	require.Len(t, plan.CanonicalNameChanges, 1)
+	require.Empty(t, plan.ToRemove)
+	require.Equal(t, 3, plan.InvocationsBeforeDeregistration)
+	require.False(t, plan.DeregisterImmediately)
+
+	// A threshold of one already removes at once, so the change is not what removed the target
+	s.Config.InvocationsBeforeDeregistration = 1
+	s.Client = &fakeELB{targets: registered}
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, plan.ToRemove)
+	require.False(t, plan.DeregisterImmediately)
+	require.Equal(t, "missed 1 times", plan.Reasons["10.0.0.1"])
+	s.Config.InvocationsBeforeDeregistration = 3
+
+	// A resolver that cannot report the chain is not a change
+	s.Resolver = staticResolver{"www.example.com": ipAddrs("10.0.0.1")}
+	s.Client = &fakeELB{targets: registered}
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Empty(t, plan.CanonicalNameChanges)
+	require.Equal(t, previous.CanonicalNames, plan.NewState.CanonicalNames)
+}
@@ -0,0 +1,219 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dotScheme = "tls://"
+	dohScheme = "https://"
+	// dnsMessageType is the media type of DNS over HTTPS requests and responses
+	dnsMessageType = "application/dns-message"
+	// maxDNSMessageSize is the largest DNS message that fits in its 16 bit length
+	maxDNSMessageSize = 65535
+	// defaultDNSTimeout matches the miekg/dns default
+	defaultDNSTimeout = time.Second * 2
+)
+
+// ServerOptions configure the resolvers made for DNS servers
+type ServerOptions struct {
+	// Quorum is how NewMultiResolver combines the answers of several servers.  SRV lookups always use the first
+	// answer.
+	Quorum Quorum
+	// Timeout of each query.  Zero uses a 2 second default.
+	Timeout time.Duration
+	// RootCAs verify tls:// and https:// servers.  Nil uses the system roots.
+	RootCAs *x509.CertPool
+	// FailuresBeforeCooldown is how many lookups in a row a server of NewMultiResolver can fail before it is skipped
+	// for Cooldown.  Zero uses a default of 3.
+	FailuresBeforeCooldown int
+	// Cooldown defaults to 30 seconds
+	Cooldown time.Duration
+	// ResolvConf has the search domains and ndots NewMultiResolver expands names with, and the nameservers it uses when
+	// given no servers.  Defaults to /etc/resolv.conf.
+	ResolvConf string
+	// HostsFile is checked by NewMultiResolver before asking DNS.  Defaults to /etc/hosts.
+	HostsFile string
+}
+
+// NewServerResolver makes a resolver for a DNS server.  tls://host[:port] servers are queried over TLS, port 853 by
+// default.  https:// servers are URLs queried over HTTPS, at /dns-query if the URL has no path.  Anything else is a
+// host[:port] queried over UDP, port 53 by default.
+func NewServerResolver(server string, opts ServerOptions) (RecordResolver, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    opts.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	switch {
+	case strings.HasPrefix(server, dotScheme):
+		address := strings.TrimPrefix(server, dotScheme)
+		if address == "" {
+			return nil, fmt.Errorf("missing host in DNS server %s", server)
+		}
+		return &DoTResolver{
+			Server:    withDefaultPort(address, "853"),
+			TLSConfig: tlsConfig,
+			Timeout:   timeout,
+		}, nil
+	case strings.HasPrefix(server, dohScheme):
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse DNS server %s: %w", server, err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host in DNS server %s", server)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return &DoHResolver{
+			URL: u.String(),
+			Client: &http.Client{
+				Timeout: timeout,
+				Transport: &http.Transport{
+					Proxy:             http.ProxyFromEnvironment,
+					TLSClientConfig:   tlsConfig,
+					ForceAttemptHTTP2: true,
+				},
+			},
+		}, nil
+	case strings.Contains(server, "://"):
+		return nil, fmt.Errorf("unsupported scheme in DNS server %s", server)
+	}
+	return &DNSServerResolver{
+		Server:  withDefaultPort(server, "53"),
+		Timeout: timeout,
+	}, nil
+}
+
+// DoTResolver queries a single DNS server over TLS (RFC 7858)
+type DoTResolver struct {
+	// Server is the host:port of the DNS server
+	Server string
+	// TLSConfig is optional.  The server's certificate is verified for the host of Server unless
+	// TLSConfig.ServerName says otherwise.
+	TLSConfig *tls.Config
+	// Timeout of each query.  Zero uses the miekg/dns default.
+	Timeout time.Duration
+}
+
+func (d *DoTResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ans, err := d.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Addrs, nil
+}
+
+func (d *DoTResolver) Resolve(ctx context.Context, host string) (*Answer, error) {
+	return resolveWith(ctx, d.exchange, dotScheme+d.Server, host)
+}
+
+func (d *DoTResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	return lookupSRVAnswer(ctx, d, service, proto, name)
+}
+
+func (d *DoTResolver) ResolveSRV(ctx context.Context, name string) (*SRVAnswer, error) {
+	return lookupSRVWith(ctx, d.exchange, dotScheme+d.Server, name)
+}
+
+func (d *DoTResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: d.TLSConfig,
+		Timeout:   d.Timeout,
+	}
+	resp, _, err := client.ExchangeContext(ctx, msg, d.Server)
+	return resp, err
+}
+
+var _ RecordResolver = &DoTResolver{}
+
+var _ SRVRecordResolver = &DoTResolver{}
+
+// DoHResolver queries a single DNS over HTTPS server (RFC 8484)
+type DoHResolver struct {
+	// URL of the server's query endpoint, like https://dns.example.com/dns-query
+	URL string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (d *DoHResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ans, err := d.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Addrs, nil
+}
+
+func (d *DoHResolver) Resolve(ctx context.Context, host string) (*Answer, error) {
+	return resolveWith(ctx, d.exchange, d.URL, host)
+}
+
+func (d *DoHResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	return lookupSRVAnswer(ctx, d, service, proto, name)
+}
+
+func (d *DoHResolver) ResolveSRV(ctx context.Context, name string) (*SRVAnswer, error) {
+	return lookupSRVWith(ctx, d.exchange, d.URL, name)
+}
+
+func (d *DoHResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// RFC 8484 recommends an ID of zero, so responses can be cached
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to pack query: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to make request: %w", err)
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unable to unpack response: %w", err)
+	}
+	return ret, nil
+}
+
+var _ RecordResolver = &DoHResolver{}
+
+var _ SRVRecordResolver = &DoHResolver{}
@@ -0,0 +1,205 @@
+package syncer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate returns a self signed certificate for 127.0.0.1 and a pool that trusts it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test dns server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startDoTServer serves zone over TLS and returns the server's host:port
+func startDoTServer(t *testing.T, cert tls.Certificate, zone map[uint16][]dns.RR) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	server := &dns.Server{
+		Listener: l,
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			_ = w.WriteMsg(answerFromZone(zone, r))
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return l.Addr().String()
+}
+
+// startDoHServer serves zone over HTTPS at /dns-query
+func startDoHServer(t *testing.T, cert tls.Certificate, zone map[uint16][]dns.RR) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/dns-query" || req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		b, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		var msg dns.Msg
+		if err := msg.Unpack(b); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, err := answerFromZone(zone, &msg).Pack()
+		require.NoError(t, err)
+		rw.Header().Set("Content-Type", dnsMessageType)
+		_, _ = rw.Write(packed)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func encryptedTestZone(t *testing.T) map[uint16][]dns.RR {
+	return map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.example.com. 300 IN CNAME lb.example.com."),
+			mustRR(t, "lb.example.com. 60 IN A 1.2.3.4"),
+		},
+		dns.TypeSRV: {
+			mustRR(t, "_http._tcp.example.com. 60 IN SRV 10 5 8080 lb.example.com."),
+		},
+	}
+}
+
+func TestDoTResolver(t *testing.T) {
+	cert, pool := testCertificate(t)
+	addr := startDoTServer(t, cert, encryptedTestZone(t))
+	ctx := context.Background()
+
+	r, err := NewServerResolver("tls://"+addr, ServerOptions{RootCAs: pool, Timeout: time.Second})
+	require.NoError(t, err)
+	ans, err := r.Resolve(ctx, "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4"}, ipStrings(ans.Addrs))
+	require.Equal(t, time.Second*60, ans.TTL)
+	require.Equal(t, "tls://"+addr, ans.Server)
+	_, records, err := r.(SRVResolver).LookupSRV(ctx, "http", "tcp", "example.com")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint16(8080), records[0].Port)
+
+	_, err = r.Resolve(ctx, "missing.example.com")
+	require.Error(t, err)
+
+	untrusted, err := NewServerResolver("tls://"+addr, ServerOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	_, err = untrusted.Resolve(ctx, "www.example.com")
+	require.Error(t, err, "the server's certificate is not trusted")
+}
+
+func TestDoHResolver(t *testing.T) {
+	cert, pool := testCertificate(t)
+	server := startDoHServer(t, cert, encryptedTestZone(t))
+	ctx := context.Background()
+
+	r, err := NewServerResolver(server.URL, ServerOptions{RootCAs: pool, Timeout: time.Second})
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/dns-query", r.(*DoHResolver).URL)
+	ans, err := r.Resolve(ctx, "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4"}, ipStrings(ans.Addrs))
+	require.Equal(t, time.Second*60, ans.TTL)
+	require.Equal(t, server.URL+"/dns-query", ans.Server)
+	_, records, err := r.(SRVResolver).LookupSRV(ctx, "http", "tcp", "example.com")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	_, err = r.Resolve(ctx, "missing.example.com")
+	require.Error(t, err)
+
+	untrusted, err := NewServerResolver(server.URL, ServerOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	_, err = untrusted.Resolve(ctx, "www.example.com")
+	require.Error(t, err, "the server's certificate is not trusted")
+
+	wrongPath, err := NewServerResolver(server.URL+"/other", ServerOptions{RootCAs: pool, Timeout: time.Second})
+	require.NoError(t, err)
+	_, err = wrongPath.Resolve(ctx, "www.example.com")
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "400"), err.Error())
+}
+
+func TestDoHResolverTimeout(t *testing.T) {
+	cert, pool := testCertificate(t)
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	defer close(release)
+	r, err := NewServerResolver(server.URL, ServerOptions{RootCAs: pool, Timeout: time.Millisecond * 100})
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = r.Resolve(context.Background(), "www.example.com")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second*5)
+}
+
+func TestNewServerResolver(t *testing.T) {
+	r, err := NewServerResolver("10.0.0.2", ServerOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &DNSServerResolver{Server: "10.0.0.2:53", Timeout: defaultDNSTimeout}, r)
+
+	r, err = NewServerResolver("tls://dns.example.com", ServerOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	require.Equal(t, "dns.example.com:853", r.(*DoTResolver).Server)
+	require.Equal(t, time.Second, r.(*DoTResolver).Timeout)
+
+	r, err = NewServerResolver("https://dns.example.com/resolve", ServerOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "https://dns.example.com/resolve", r.(*DoHResolver).URL)
+
+	for _, bad := range []string{"tls://", "https://", "https://dns.example.com/%zz", "quic://dns.example.com"} {
+		_, err = NewServerResolver(bad, ServerOptions{})
+		require.Error(t, err, bad)
+	}
+
+	_, err = NewMultiResolver(nil, []string{"10.0.0.2", "quic://dns.example.com"}, ServerOptions{})
+	require.Error(t, err)
+}
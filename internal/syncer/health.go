@@ -0,0 +1,58 @@
+package syncer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+)
+
+func targetHealthState(t *elbv2.TargetHealthDescription) string {
+	if t == nil || t.TargetHealth == nil {
+		return ""
+	}
+	return aws.StringValue(t.TargetHealth.State)
+}
+
+// applyHealth records the health of each target in newState.  If Config.UnhealthyInvocationsBeforeDeregistration is
+// set, targets DNS still returns are deregistered once they are unhealthy that many syncs in a row.  They are then kept
+// out of the target group for as many syncs again before being registered to try again.
+func (s *Syncer) applyHealth(previousResult state.State, currentTargets map[string]*elbv2.TargetHealthDescription, toRemove []string, toAdd []string, newState state.State) ([]string, []string, state.State) {
+	limit := s.Config.UnhealthyInvocationsBeforeDeregistration
+	previousUnhealthy := make(map[string]int, len(previousResult.Targets))
+	for _, t := range previousResult.Targets {
+		previousUnhealthy[TargetKey(t.IP, t.Port)] = t.TimesUnhealthy
+	}
+	adding := listToSet(toAdd)
+	for i := range newState.Targets {
+		t := &newState.Targets[i]
+		key := TargetKey(t.IP, t.Port)
+		current, registered := currentTargets[key]
+		t.Health = targetHealthState(current)
+		if limit <= 0 || t.TimesMissing > 0 {
+			continue
+		}
+		switch {
+		case registered && t.Health == elbv2.TargetHealthStateEnumUnhealthy:
+			t.TimesUnhealthy = previousUnhealthy[key] + 1
+			if t.TimesUnhealthy >= limit {
+				toRemove = append(toRemove, key)
+			}
+		case !registered && previousUnhealthy[key] >= limit:
+			// Removed for being unhealthy: wait before trying again
+			t.TimesUnhealthy = previousUnhealthy[key] + 1
+			if t.TimesUnhealthy < limit*2 {
+				t.Health = elbv2.TargetHealthStateEnumUnhealthy
+				delete(adding, key)
+			} else {
+				t.TimesUnhealthy = 0
+			}
+		}
+	}
+	if len(adding) != len(toAdd) {
+		toAdd = make([]string, 0, len(adding))
+		for key := range adding {
+			toAdd = append(toAdd, key)
+		}
+	}
+	return toRemove, toAdd, newState
+}
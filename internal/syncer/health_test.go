@@ -0,0 +1,93 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncSingleSkipsDraining(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+			{Id: aws.String("1.2.3.6")},
+		},
+		health: map[string]string{
+			"1.2.3.4": elbv2.TargetHealthStateEnumHealthy,
+			"1.2.3.5": elbv2.TargetHealthStateEnumDraining,
+			"1.2.3.6": elbv2.TargetHealthStateEnumDraining,
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration: 1,
+			RemoveUnknownTgIP:               true,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4", "1.2.3.6"),
+		},
+	}
+	plan, err := s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"a.example.com"}}, state.State{})
+	require.NoError(t, err)
+	require.Empty(t, plan.ToRemove, "1.2.3.5 is already draining")
+	require.Equal(t, []string{"1.2.3.6"}, plan.ToAdd, "DNS returns 1.2.3.6 again")
+	require.Empty(t, client.deregistered)
+	require.Equal(t, []state.Target{
+		{IP: "1.2.3.4", Health: elbv2.TargetHealthStateEnumHealthy},
+		{IP: "1.2.3.6"},
+	}, plan.NewState.Targets)
+}
+
+func TestSyncSingleUnhealthy(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+		},
+		health: map[string]string{
+			"1.2.3.4": elbv2.TargetHealthStateEnumHealthy,
+			"1.2.3.5": elbv2.TargetHealthStateEnumUnhealthy,
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration:          1,
+			UnhealthyInvocationsBeforeDeregistration: 2,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4", "1.2.3.5"),
+		},
+	}
+	ctx := context.Background()
+	mapping := state.Mapping{Hostnames: []string{"a.example.com"}}
+	plan, err := s.syncSingle(ctx, "arn:test", mapping, state.State{})
+	require.NoError(t, err)
+	require.Empty(t, plan.ToRemove)
+	require.Equal(t, state.Target{IP: "1.2.3.5", Health: elbv2.TargetHealthStateEnumUnhealthy, TimesUnhealthy: 1}, plan.NewState.Targets[1])
+
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, plan.NewState)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.5"}, plan.ToRemove)
+	require.Len(t, client.deregistered, 1)
+	require.Len(t, plan.NewState.Targets, 2, "still tracked while DNS returns it")
+
+	// Out of the target group, it is not registered again until it waits as many syncs
+	client.targets = client.targets[:1]
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, plan.NewState)
+	require.NoError(t, err)
+	require.Empty(t, plan.ToAdd)
+	plan, err = s.syncSingle(ctx, "arn:test", mapping, plan.NewState)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.5"}, plan.ToAdd)
+	require.Equal(t, state.Target{IP: "1.2.3.5"}, plan.NewState.Targets[1])
+}
@@ -0,0 +1,70 @@
+package syncer
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/notify"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"go.uber.org/zap"
+)
+
+// syncFailed counts a failed sync of a target group.  It returns a failure to notify about when the target group has
+// failed Config.FailuresBeforeNotification syncs in a row.  Longer streaks are only notified once.
+func (s *Syncer) syncFailed(targetGroupARN state.TargetGroupARN, mapping state.Mapping, err error) *notify.Failure {
+	if s.Notifier == nil || s.Config.FailuresBeforeNotification <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == nil {
+		s.failures = make(map[state.TargetGroupARN]int)
+	}
+	s.failures[targetGroupARN]++
+	if s.failures[targetGroupARN] != s.Config.FailuresBeforeNotification {
+		return nil
+	}
+	return &notify.Failure{
+		TargetGroupARN: string(targetGroupARN),
+		Hostnames:      mapping.Hostnames,
+		Failures:       s.failures[targetGroupARN],
+		Error:          err.Error(),
+	}
+}
+
+// syncSucceeded ends the failure streak of a target group, and returns its change to notify about if it changed
+func (s *Syncer) syncSucceeded(targetGroupARN state.TargetGroupARN, plan *Plan) *notify.Change {
+	if s.Notifier == nil {
+		return nil
+	}
+	s.mu.Lock()
+	delete(s.failures, targetGroupARN)
+	s.mu.Unlock()
+	if s.Config.DryRun || (len(plan.ToAdd) == 0 && len(plan.ToRemove) == 0) {
+		return nil
+	}
+	return &notify.Change{
+		TargetGroupARN: string(targetGroupARN),
+		Hostnames:      plan.Hostnames,
+		Added:          plan.ToAdd,
+		Removed:        plan.ToRemove,
+	}
+}
+
+// sendNotification tells Syncer.Notifier about every change and failure of a sync at once
+func (s *Syncer) sendNotification(ctx context.Context, n notify.Notification) {
+	if s.Notifier == nil || s.Config.DryRun || n.Empty() {
+		return
+	}
+	sort.Slice(n.Changes, func(i, j int) bool {
+		return n.Changes[i].TargetGroupARN < n.Changes[j].TargetGroupARN
+	})
+	sort.Slice(n.Failures, func(i, j int) bool {
+		return n.Failures[i].TargetGroupARN < n.Failures[j].TargetGroupARN
+	})
+	n.Time = time.Now()
+	if err := s.Notifier.Notify(ctx, n); err != nil {
+		s.Log.IfErr(err).Warn(ctx, "unable to send notification", zap.Int("changes", len(n.Changes)), zap.Int("failures", len(n.Failures)))
+	}
+}
@@ -0,0 +1,114 @@
+package syncer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/notify"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []notify.Notification
+}
+
+func (r *recordingNotifier) Notify(_ context.Context, n notify.Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func (r *recordingNotifier) notifications() []notify.Notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]notify.Notification(nil), r.sent...)
+}
+
+func TestSyncNotifies(t *testing.T) {
+	notifier := &recordingNotifier{}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: &fakeELB{},
+		State:  &memoryStorage{},
+		Config: Config{
+			FailuresBeforeNotification: 2,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+			"b.example.com": ipAddrs("1.2.3.5"),
+		},
+		SyncFinder: staticSyncFinder{
+			"arn:b":    {Hostnames: []string{"b.example.com"}},
+			"arn:a":    {Hostnames: []string{"a.example.com"}},
+			"arn:fail": {Hostnames: []string{"missing.example.com"}},
+		},
+		Notifier: notifier,
+	}
+	ctx := context.Background()
+	require.NoError(t, s.Sync(ctx))
+	require.Len(t, notifier.sent, 1, "one notification per sync")
+	require.Equal(t, []notify.Change{
+		{TargetGroupARN: "arn:a", Hostnames: []string{"a.example.com"}, Added: []string{"1.2.3.4"}, Removed: []string{}},
+		{TargetGroupARN: "arn:b", Hostnames: []string{"b.example.com"}, Added: []string{"1.2.3.5"}, Removed: []string{}},
+	}, notifier.sent[0].Changes)
+	require.Empty(t, notifier.sent[0].Failures, "one failure is not enough")
+
+	// fakeELB does not remember registrations, so the same targets are added again
+	require.NoError(t, s.Sync(ctx))
+	require.Len(t, notifier.sent, 2)
+	require.Len(t, notifier.sent[1].Failures, 1)
+	require.Equal(t, "arn:fail", notifier.sent[1].Failures[0].TargetGroupARN)
+	require.Equal(t, 2, notifier.sent[1].Failures[0].Failures)
+
+	// A streak is only notified once
+	require.NoError(t, s.Sync(ctx))
+	require.Empty(t, notifier.sent[2].Failures)
+
+	// Recovering starts a new streak
+	s.Resolver.(staticResolver)["missing.example.com"] = ipAddrs("1.2.3.6")
+	require.NoError(t, s.Sync(ctx))
+	require.Equal(t, 0, s.failures[state.TargetGroupARN("arn:fail")])
+
+	s.Config.DryRun = true
+	sent := len(notifier.sent)
+	require.NoError(t, s.Sync(ctx))
+	require.Len(t, notifier.sent, sent, "dry runs notify nothing")
+}
+
+func TestSyncSendsHeldNotifications(t *testing.T) {
+	notifier := &recordingNotifier{}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: &fakeELB{},
+		State:  &memoryStorage{},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+		SyncFinder: staticSyncFinder{
+			"arn:a": {Hostnames: []string{"a.example.com"}},
+		},
+		Notifier: &notify.RateLimited{
+			Notifier: notifier,
+			Interval: time.Millisecond * 50,
+		},
+	}
+	ctx := context.Background()
+	require.NoError(t, s.Sync(ctx))
+	require.Len(t, notifier.notifications(), 1)
+
+	// fakeELB does not remember registrations, so the target is added again, within the interval
+	require.NoError(t, s.Sync(ctx))
+	require.Len(t, notifier.notifications(), 1)
+
+	// The held change is sent without another sync
+	require.Eventually(t, func() bool {
+		return len(notifier.notifications()) == 2
+	}, time.Second, time.Millisecond*10)
+	require.Equal(t, "arn:a", notifier.notifications()[1].Changes[0].TargetGroupARN)
+}
@@ -0,0 +1,208 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"go.uber.org/zap"
+)
+
+// Plan is the set of changes a sync would make to a single target group
+type Plan struct {
+	TargetGroupARN state.TargetGroupARN
+	Hostnames      []string
+	ToAdd          []string
+	ToRemove       []string
+	// HeldRemovals are targets that would be removed, but are held by the shrink limit or the minimum target floor
+	HeldRemovals []string
+	// HoldReason says why HeldRemovals are held
+	HoldReason string
+	// Reasons says why each target of ToAdd and ToRemove changes
+	Reasons map[string]string
+	// NewState is the state a sync would store, including the miss counter of every tracked target
+	NewState state.State
+	// InvocationsBeforeDeregistration is the number of syncs a target of NewState may be missing before it is removed,
+	// after per-mapping overrides and a canonical name change
+	InvocationsBeforeDeregistration int
+	// DeregisterImmediately is true if a canonical name change lowered InvocationsBeforeDeregistration, so targets
+	// missing from DNS are removed at once
+	DeregisterImmediately bool
+	// TTL is the shortest DNS TTL of the hostnames.  Zero if the resolver does not report TTLs.
+	TTL time.Duration
+	// Resolvers are the DNS servers that answered for the hostnames, if the resolver reports them
+	Resolvers []string
+	// CNAMEChains are the CNAME chains of hostnames that are a CNAME, by hostname
+	CNAMEChains map[string][]string
+	// CanonicalNameChanges are hostnames whose CNAME chain ends somewhere new since the last sync
+	CanonicalNameChanges []CanonicalNameChange
+	// Error is set if the target group could not be planned
+	Error string
+
+	currentTargets map[string]*elbv2.TargetHealthDescription
+}
+
+const (
+	holdReasonShrinkLimit = "shrink limit"
+	holdReasonMinTargets  = "minimum targets"
+)
+
+// Plan returns the changes a sync would make to every target group.  It only reads from ELB and state storage.
+func (s *Syncer) Plan(ctx context.Context) ([]Plan, error) {
+	s.Log.Debug(ctx, "<- Plan")
+	defer s.Log.Debug(ctx, "-> Plan")
+	toSyncMap, err := s.SyncFinder.ToSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tg to sync: %w", err)
+	}
+	currentStates, err := s.getStates(ctx, toSyncMap)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Plan, 0, len(toSyncMap))
+	var mu sync.Mutex
+	s.forEachTargetGroup(ctx, toSyncMap, func(ctx context.Context, tgArn state.TargetGroupARN, mapping state.Mapping, key state.Keys) {
+		var p *Plan
+		client, err := s.clientFor(mapping)
+		if err == nil {
+			p, err = s.planSingle(ctx, client, tgArn, mapping, currentStates[key])
+		}
+		if err != nil {
+			p = &Plan{
+				TargetGroupARN: tgArn,
+				Hostnames:      mapping.Hostnames,
+				Error:          err.Error(),
+			}
+		}
+		mu.Lock()
+		ret = append(ret, *p)
+		mu.Unlock()
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].TargetGroupARN < ret[j].TargetGroupARN
+	})
+	return ret, nil
+}
+
+// Registered returns the targets the target group has once the plan is applied
+func (p *Plan) Registered() []string {
+	removed := listToSet(p.ToRemove)
+	ret := make([]string, 0, len(p.currentTargets)+len(p.ToAdd))
+	for key := range p.currentTargets {
+		if _, exists := removed[key]; !exists {
+			ret = append(ret, key)
+		}
+	}
+	ret = append(ret, p.ToAdd...)
+	sort.Strings(ret)
+	return ret
+}
+
+// getStates returns the previously stored state of each mapping
+func (s *Syncer) getStates(ctx context.Context, toSyncMap map[state.TargetGroupARN]state.Mapping) (map[state.Keys]state.State, error) {
+	currentStates, err := s.State.GetStates(ctx, getSyncKeys(toSyncMap))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get any states: %w", err)
+	}
+	s.Log.Debug(ctx, "fetched states", zap.Int("len_states", len(currentStates)))
+	return currentStates, nil
+}
+
+func (s *Syncer) planSingle(ctx context.Context, client elbv2iface.ELBV2API, targetGroupARN state.TargetGroupARN, mapping state.Mapping, previousResult state.State) (*Plan, error) {
+	if mapping.HasSRV() && mapping.Port == 0 && len(mapping.Hostnames) > 1 {
+		for _, h := range mapping.Hostnames {
+			if !strings.HasPrefix(h, state.SRVPrefix) {
+				// Targets of SRV records are compared by port, so other hostnames need a port to compare
+				return nil, fmt.Errorf("hostname %s of %s needs a port to sync alongside SRV records", h, targetGroupARN)
+			}
+		}
+	}
+	ipv6, err := s.isIPv6TargetGroup(ctx, client, targetGroupARN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ip address type of %s: %w", targetGroupARN, err)
+	}
+	resolver, err := s.resolverFor(mapping)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make resolver for %s: %w", targetGroupARN, err)
+	}
+	res, err := s.resolveAllIPs(ctx, resolver, mapping.Hostnames, ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve IPs for %s: %w", targetGroupARN, err)
+	}
+	resolvedTargets := make([]string, 0, len(res.IPs)+len(res.SRVTargets))
+	for _, ip := range res.IPs {
+		resolvedTargets = append(resolvedTargets, TargetKey(ip, mapping.Port))
+	}
+	resolvedTargets = append(resolvedTargets, res.SRVTargets...)
+	currentTargets, err := s.getTargetGroupTargets(ctx, client, targetGroupARN, mapping.Port != 0 || mapping.HasSRV())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get target group IPs %s: %w", targetGroupARN, err)
+	}
+	currentlyStoredIPs := make([]string, 0, len(currentTargets))
+	for k := range currentTargets {
+		currentlyStoredIPs = append(currentlyStoredIPs, k)
+	}
+	s.Log.Debug(ctx, "found current IPs", zap.String("targetgroup_arn", string(targetGroupARN)), zap.Strings("ips", currentlyStoredIPs))
+
+	cfg := s.Config.withOverrides(mapping)
+	canonicalNames := keepCanonicalNames(previousResult.CanonicalNames, canonicalNamesOf(res.Chains), res.UnknownChains)
+	canonicalNameChanges := diffCanonicalNames(previousResult.CanonicalNames, canonicalNames)
+	invocationsBeforeDeregistration := cfg.InvocationsBeforeDeregistration
+	// Targets are not tracked by hostname, so with several hostnames the missing targets may belong to one that did not
+	// change
+	if len(canonicalNameChanges) > 0 && cfg.DeregisterOnCanonicalNameChange && len(mapping.Hostnames) == 1 {
+		invocationsBeforeDeregistration = 1
+	}
+	deregisterImmediately := invocationsBeforeDeregistration != cfg.InvocationsBeforeDeregistration
+	ipToRemove, ipToAdd, newState := resolve(previousResult, currentlyStoredIPs, resolvedTargets, invocationsBeforeDeregistration, cfg.RemoveUnknownTgIP)
+	ipToRemove, ipToAdd, newState = s.applyHealth(previousResult, currentTargets, ipToRemove, ipToAdd, newState)
+	sort.Strings(ipToRemove)
+	// Both holds take from the front of ipToRemove, so the held targets are always a prefix of it
+	heldRemovals := cfg.shrinkLimitHold(len(currentTargets), ipToRemove)
+	var holdReason string
+	if len(heldRemovals) > 0 {
+		holdReason = holdReasonShrinkLimit
+	}
+	if held := cfg.minTargetsHold(len(resolvedTargets), len(currentTargets), ipToRemove[len(heldRemovals):]); len(held) > 0 {
+		heldRemovals = ipToRemove[:len(heldRemovals)+len(held)]
+		if holdReason == "" {
+			holdReason = holdReasonMinTargets
+		}
+	}
+	if len(heldRemovals) > 0 {
+		ipToRemove = ipToRemove[len(heldRemovals):]
+		newState = holdTargets(newState, heldRemovals, cfg.InvocationsBeforeDeregistration)
+	}
+	for i := range newState.Targets {
+		t := &newState.Targets[i]
+		t.AvailabilityZone = mapping.AvailabilityZone
+		if t.Health == "" {
+			t.Health = targetHealthState(currentTargets[TargetKey(t.IP, t.Port)])
+		}
+	}
+	newState.CanonicalNames = canonicalNames
+	sort.Strings(ipToAdd)
+	return &Plan{
+		TargetGroupARN:                  targetGroupARN,
+		Hostnames:                       mapping.Hostnames,
+		ToAdd:                           ipToAdd,
+		ToRemove:                        ipToRemove,
+		HeldRemovals:                    heldRemovals,
+		HoldReason:                      holdReason,
+		Reasons:                         s.changeReasons(previousResult, newState, ipToAdd, ipToRemove, deregisterImmediately),
+		NewState:                        newState,
+		InvocationsBeforeDeregistration: invocationsBeforeDeregistration,
+		DeregisterImmediately:           deregisterImmediately,
+		TTL:                             res.TTL,
+		Resolvers:                       res.Servers,
+		CNAMEChains:                     res.Chains,
+		CanonicalNameChanges:            canonicalNameChanges,
+		currentTargets:                  currentTargets,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package syncer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultResolvConf = "/etc/resolv.conf"
+	defaultHostsFile  = "/etc/hosts"
+	// hostsFileServerName is the Answer.Server of addresses found in the hosts file
+	hostsFileServerName = "hosts"
+)
+
+// addressFamilyKey is the context key of the address family lookups ask for
+type addressFamilyKey struct{}
+
+// withAddressFamily makes lookups with ctx only ask for IPv6 or IPv4 addresses, so a failure of the family a target
+// group cannot use does not fail its sync
+func withAddressFamily(ctx context.Context, ipv6 bool) context.Context {
+	return context.WithValue(ctx, addressFamilyKey{}, ipv6)
+}
+
+// queryTypes returns the record types a lookup with ctx asks for: both A and AAAA unless withAddressFamily picked one
+func queryTypes(ctx context.Context) []uint16 {
+	ipv6, exists := ctx.Value(addressFamilyKey{}).(bool)
+	switch {
+	case !exists:
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	case ipv6:
+		return []uint16{dns.TypeAAAA}
+	default:
+		return []uint16{dns.TypeA}
+	}
+}
+
+// familyNetwork returns the net.Resolver network of a lookup with ctx
+func familyNetwork(ctx context.Context) string {
+	switch qtypes := queryTypes(ctx); {
+	case len(qtypes) > 1:
+		return "ip"
+	case qtypes[0] == dns.TypeAAAA:
+		return "ip6"
+	default:
+		return "ip4"
+	}
+}
+
+// inFamily returns the addresses of the family a lookup with ctx asks for
+func inFamily(ctx context.Context, addrs []net.IPAddr) []net.IPAddr {
+	network := familyNetwork(ctx)
+	if network == "ip" {
+		return addrs
+	}
+	ret := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (network == "ip4") {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
+
+// loadResolvConf reads the search domains, ndots, and nameservers of a resolv.conf.  A missing file returns nil, like
+// a system with no search domains.
+func loadResolvConf(path string) (*dns.ClientConfig, error) {
+	ret, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+// nameList returns the names to try for host, in order, applying the search domains of config like the operating
+// system's resolver.  Names ending in a dot are absolute.
+func nameList(config *dns.ClientConfig, host string) []string {
+	if config == nil {
+		return []string{host}
+	}
+	return config.NameList(host)
+}
+
+// hostsFile looks up names in a hosts file, like the operating system's resolver does before asking DNS.  The file is
+// read again when it changes.
+type hostsFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	addrs   map[string][]net.IPAddr
+}
+
+// lookup returns the addresses of host in the file, or nil if it has none
+func (h *hostsFile) lookup(host string) []net.IPAddr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info, err := os.Stat(h.path)
+	if err != nil {
+		// Like a missing file, an unreadable one has no hosts
+		return nil
+	}
+	if h.addrs == nil || !info.ModTime().Equal(h.modTime) || info.Size() != h.size {
+		h.addrs = readHostsFile(h.path)
+		h.modTime = info.ModTime()
+		h.size = info.Size()
+	}
+	return h.addrs[normalizeName(host)]
+}
+
+// readHostsFile parses lines of an address followed by its names.  Anything after a # is a comment.
+func readHostsFile(path string) map[string][]net.IPAddr {
+	ret := make(map[string][]net.IPAddr)
+	f, err := os.Open(path)
+	if err != nil {
+		return ret
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, zone, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = normalizeName(name)
+			ret[name] = append(ret[name], net.IPAddr{IP: ip, Zone: zone})
+		}
+	}
+	return ret
+}
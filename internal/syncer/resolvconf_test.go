@@ -0,0 +1,137 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestMultiResolverSearchDomains(t *testing.T) {
+	addr := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.internal.example.com. 60 IN A 10.0.0.1"),
+			mustRR(t, "www.example.com. 60 IN A 10.0.0.2"),
+		},
+		dns.TypeSRV: {
+			mustRR(t, "_http._tcp.internal.example.com. 60 IN SRV 10 5 8080 www.internal.example.com."),
+		},
+	})
+	opts := ServerOptions{
+		ResolvConf: writeTestFile(t, "resolv.conf", "search internal.example.com\noptions ndots:2\n"),
+		HostsFile:  filepath.Join(t.TempDir(), "missing"),
+	}
+	m, err := NewMultiResolver(testhelp.ZapTestingLogger(t), []string{addr}, opts)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	ans, err := m.Resolve(ctx, "www")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, ipStrings(ans.Addrs))
+	// Fewer dots than ndots tries the search domains first
+	ans, err = m.Resolve(ctx, "www.example")
+	require.Error(t, err)
+	require.Nil(t, ans)
+	ans, err = m.Resolve(ctx, "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2"}, ipStrings(ans.Addrs))
+	_, err = m.Resolve(ctx, "www.")
+	require.Error(t, err, "absolute names are not searched")
+
+	_, records, err := m.LookupSRV(ctx, "", "", "_http._tcp")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestMultiResolverResolvConfServers(t *testing.T) {
+	opts := ServerOptions{
+		ResolvConf: writeTestFile(t, "resolv.conf", "nameserver 10.0.0.2\nnameserver fd00::2\n"),
+	}
+	m, err := NewMultiResolver(testhelp.ZapTestingLogger(t), nil, opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2:53", "[fd00::2]:53"}, m.names)
+	require.Equal(t, &DNSServerResolver{Server: "10.0.0.2:53", Timeout: defaultDNSTimeout}, m.coreResolvers[0])
+
+	opts.ResolvConf = filepath.Join(t.TempDir(), "missing")
+	m, err = NewMultiResolver(testhelp.ZapTestingLogger(t), nil, opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{systemResolverName}, m.names)
+	require.Nil(t, m.resolvConf)
+}
+
+func TestMultiResolverHostsFile(t *testing.T) {
+	addr := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeAAAA: {
+			mustRR(t, "db.example.com. 60 IN AAAA 2001:db8::1"),
+		},
+	})
+	hosts := writeTestFile(t, "hosts", "# comment\n10.0.0.5 db.example.com db # trailing comment\n\n::1 localhost\n")
+	m, err := NewMultiResolver(testhelp.ZapTestingLogger(t), []string{addr}, ServerOptions{
+		ResolvConf: filepath.Join(t.TempDir(), "missing"),
+		HostsFile:  hosts,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	ans, err := m.Resolve(ctx, "DB.example.com.")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.5"}, ipStrings(ans.Addrs))
+	require.Equal(t, hostsFileServerName, ans.Server)
+	require.Equal(t, time.Duration(0), ans.TTL)
+
+	// The hosts file has no IPv6 address, so DNS is asked
+	ans, err = m.Resolve(withAddressFamily(ctx, true), "db.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"2001:db8::1"}, ipStrings(ans.Addrs))
+	require.Equal(t, addr, ans.Server)
+
+	// Changes are picked up
+	require.NoError(t, os.WriteFile(hosts, []byte("10.0.0.6 db.example.com\n"), 0o600))
+	require.NoError(t, os.Chtimes(hosts, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	ans, err = m.Resolve(ctx, "db.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.6"}, ipStrings(ans.Addrs))
+}
+
+func TestResolveAddressFamily(t *testing.T) {
+	zone := map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.example.com. 60 IN A 10.0.0.1"),
+		},
+	}
+	addr := startDNSHandler(t, func(r *dns.Msg) *dns.Msg {
+		if r.Question[0].Qtype == dns.TypeAAAA {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			return m
+		}
+		return answerFromZone(zone, r)
+	})
+	r := &DNSServerResolver{
+		Server:  addr,
+		Timeout: time.Second,
+	}
+	ctx := context.Background()
+
+	_, err := r.Resolve(ctx, "www.example.com")
+	require.Error(t, err, "without a family both are asked for")
+	ans, err := r.Resolve(withAddressFamily(ctx, false), "www.example.com")
+	require.NoError(t, err, "a failing AAAA lookup does not matter to IPv4 target groups")
+	require.Equal(t, []string{"10.0.0.1"}, ipStrings(ans.Addrs))
+	_, err = r.Resolve(withAddressFamily(ctx, true), "www.example.com")
+	require.Error(t, err)
+
+	require.Equal(t, []uint16{dns.TypeA, dns.TypeAAAA}, queryTypes(ctx))
+	require.Equal(t, "ip6", familyNetwork(withAddressFamily(ctx, true)))
+}
@@ -0,0 +1,639 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+	"github.com/cresta/zapctx"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var _ Resolver = &net.Resolver{}
+
+// Answer is the result of resolving a hostname
+type Answer struct {
+	Addrs []net.IPAddr
+	// TTL is the shortest TTL of the records that produced Addrs.  Zero means the TTL is unknown.
+	TTL time.Duration
+	// Server is the DNS server that answered, or a comma separated list if several servers' answers were combined.
+	// Empty if unknown.
+	Server string
+	// Chain is the CNAME targets followed from the host, in order.  The last is the host's canonical name.  Empty if
+	// the host is not a CNAME, or if ChainUnknown.
+	Chain []string
+	// ChainUnknown is true if the resolver could not tell whether the host is a CNAME
+	ChainUnknown bool
+}
+
+// RecordResolver is a Resolver that can also report how long its answer is valid
+type RecordResolver interface {
+	Resolver
+	Resolve(ctx context.Context, host string) (*Answer, error)
+}
+
+// SRVResolver is a Resolver that can also look up SRV records.  Like net.Resolver, an empty service and proto look up
+// name directly.
+type SRVResolver interface {
+	Resolver
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+}
+
+var _ SRVResolver = &net.Resolver{}
+
+// SRVAnswer is the result of looking up SRV records
+type SRVAnswer struct {
+	// Name is the canonical name of the records
+	Name    string
+	Records []*net.SRV
+	// TTL is the shortest TTL of the records.  Zero means the TTL is unknown.
+	TTL time.Duration
+}
+
+// SRVRecordResolver is a SRVResolver that can also report how long its SRV records are valid
+type SRVRecordResolver interface {
+	SRVResolver
+	ResolveSRV(ctx context.Context, name string) (*SRVAnswer, error)
+}
+
+// resolveSRVWith looks up the SRV records of name through resolver, with their TTL if resolver reports it
+func resolveSRVWith(ctx context.Context, resolver SRVResolver, name string) (*SRVAnswer, error) {
+	if recordResolver, ok := resolver.(SRVRecordResolver); ok {
+		return recordResolver.ResolveSRV(ctx, name)
+	}
+	cname, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	return &SRVAnswer{Name: cname, Records: records}, nil
+}
+
+// lookupSRVAnswer adapts ResolveSRV to the LookupSRV signature of net.Resolver
+func lookupSRVAnswer(ctx context.Context, resolver SRVRecordResolver, service string, proto string, name string) (string, []*net.SRV, error) {
+	ans, err := resolver.ResolveSRV(ctx, srvName(service, proto, name))
+	if err != nil {
+		return "", nil, err
+	}
+	return ans.Name, ans.Records, nil
+}
+
+// srvName returns the name LookupSRV looks up
+func srvName(service string, proto string, name string) string {
+	if service == "" && proto == "" {
+		return name
+	}
+	return "_" + service + "._" + proto + "." + name
+}
+
+// netResolver adapts a net.Resolver, which does not expose TTLs
+type netResolver struct {
+	*net.Resolver
+}
+
+// Resolve only reports the canonical name of the CNAME chain, since the operating system hides the links between
+func (n netResolver) Resolve(ctx context.Context, host string) (*Answer, error) {
+	ips, err := n.LookupIP(ctx, familyNetwork(ctx), host)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Answer{
+		Addrs:  make([]net.IPAddr, 0, len(ips)),
+		Server: systemResolverName,
+	}
+	for _, ip := range ips {
+		ret.Addrs = append(ret.Addrs, net.IPAddr{IP: ip})
+	}
+	cname, err := n.LookupCNAME(ctx, host)
+	switch {
+	case err != nil:
+		// The addresses are still good, but a failed lookup must not read as the host no longer being a CNAME
+		ret.ChainUnknown = true
+	case normalizeName(cname) != normalizeName(host):
+		ret.Chain = []string{normalizeName(cname)}
+	}
+	return ret, nil
+}
+
+// normalizeName makes DNS names comparable: lower case and without the trailing dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// systemResolverName is the Answer.Server of the operating system's resolver
+const systemResolverName = "system"
+
+var _ RecordResolver = netResolver{}
+
+var _ SRVResolver = netResolver{}
+
+// DNSServerResolver queries a single DNS server directly, so it can report record TTLs
+type DNSServerResolver struct {
+	// Server is the host:port of the DNS server
+	Server string
+	// Timeout of each query.  Zero uses the miekg/dns default.
+	Timeout time.Duration
+}
+
+func (d *DNSServerResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ans, err := d.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Addrs, nil
+}
+
+func (d *DNSServerResolver) Resolve(ctx context.Context, host string) (*Answer, error) {
+	return resolveWith(ctx, d.exchange, d.Server, host)
+}
+
+func (d *DNSServerResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	return lookupSRVAnswer(ctx, d, service, proto, name)
+}
+
+func (d *DNSServerResolver) ResolveSRV(ctx context.Context, name string) (*SRVAnswer, error) {
+	return lookupSRVWith(ctx, d.exchange, d.Server, name)
+}
+
+func (d *DNSServerResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Timeout: d.Timeout,
+	}
+	resp, _, err := client.ExchangeContext(ctx, msg, d.Server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, d.Server)
+	}
+	return resp, err
+}
+
+var _ RecordResolver = &DNSServerResolver{}
+
+var _ SRVRecordResolver = &DNSServerResolver{}
+
+// minTTL returns the smaller TTL, treating zero as unknown
+func minTTL(a time.Duration, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// exchangeFunc sends a DNS query to a server and returns its response
+type exchangeFunc func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+
+// resolveWith looks up the A and AAAA records of host through exchange, or only the family picked by withAddressFamily
+func resolveWith(ctx context.Context, exchange exchangeFunc, server string, host string) (*Answer, error) {
+	ret := Answer{
+		Server: server,
+	}
+	for _, qtype := range queryTypes(ctx) {
+		resp, err := query(ctx, exchange, server, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if len(ret.Chain) == 0 {
+			ret.Chain = cnameChain(host, resp.Answer)
+		}
+		for _, rr := range resp.Answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				ret.Addrs = append(ret.Addrs, net.IPAddr{IP: record.A})
+			case *dns.AAAA:
+				ret.Addrs = append(ret.Addrs, net.IPAddr{IP: record.AAAA})
+			case *dns.CNAME:
+			default:
+				continue
+			}
+			// CNAMEs count too: the answer is only valid while every link of the chain is
+			ret.TTL = minTTL(ret.TTL, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+	if len(ret.Addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	return &ret, nil
+}
+
+// cnameChain follows the CNAME records of an answer from host
+func cnameChain(host string, answer []dns.RR) []string {
+	targets := make(map[string]string)
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[normalizeName(cname.Hdr.Name)] = normalizeName(cname.Target)
+		}
+	}
+	var ret []string
+	name := normalizeName(host)
+	// Never follow more links than there are, in case the records loop
+	for i := 0; i < len(targets); i++ {
+		target, exists := targets[name]
+		if !exists {
+			break
+		}
+		ret = append(ret, target)
+		name = target
+	}
+	return ret
+}
+
+// lookupSRVWith looks up the SRV records of name through exchange
+func lookupSRVWith(ctx context.Context, exchange exchangeFunc, server string, name string) (*SRVAnswer, error) {
+	resp, err := query(ctx, exchange, server, name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	ret := SRVAnswer{
+		Name: dns.Fqdn(name),
+	}
+	for _, rr := range resp.Answer {
+		switch record := rr.(type) {
+		case *dns.SRV:
+			ret.Records = append(ret.Records, &net.SRV{
+				Target:   record.Target,
+				Port:     record.Port,
+				Priority: record.Priority,
+				Weight:   record.Weight,
+			})
+		case *dns.CNAME:
+		default:
+			continue
+		}
+		ret.TTL = minTTL(ret.TTL, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	if len(ret.Records) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	}
+	return &ret, nil
+}
+
+func query(ctx context.Context, exchange exchangeFunc, server string, host string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	resp, err := exchange(ctx, msg)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+	}
+	// NXDOMAIN for one type is still an answer: the other type may exist
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, &net.DNSError{Err: "server returned " + dns.RcodeToString[resp.Rcode], Name: host, Server: server}
+	}
+	return resp, nil
+}
+
+// Quorum is how a MultiResolver combines the answers of its DNS servers
+type Quorum string
+
+const (
+	// QuorumFirst uses the first server to answer, trying servers in a random order
+	QuorumFirst Quorum = ""
+	// QuorumUnion asks every server and uses every address any of them returned
+	QuorumUnion Quorum = "union"
+	// QuorumIntersection asks every server and uses the addresses all of them returned
+	QuorumIntersection Quorum = "intersection"
+	// QuorumMajority asks every server and uses the addresses more than half of them returned
+	QuorumMajority Quorum = "majority"
+)
+
+// ParseQuorum parses a quorum name.  Empty, or "first", is QuorumFirst.
+func ParseQuorum(s string) (Quorum, error) {
+	switch q := Quorum(strings.ToLower(strings.TrimSpace(s))); q {
+	case QuorumFirst, QuorumUnion, QuorumIntersection, QuorumMajority:
+		return q, nil
+	case "first":
+		return QuorumFirst, nil
+	}
+	return "", fmt.Errorf("unknown quorum %s: expected first, union, intersection, or majority", s)
+}
+
+// MultiResolver resolves through several DNS servers.  It tracks the health of each server: servers are tried
+// fastest first, and a server that fails several lookups in a row is skipped for a cooldown.
+type MultiResolver struct {
+	coreResolvers []RecordResolver
+	// names of each resolver, as configured
+	names                  []string
+	health                 []*serverHealth
+	quorum                 Quorum
+	failuresBeforeCooldown int
+	cooldown               time.Duration
+	// resolvConf has the search domains names are expanded with.  Nil expands nothing.
+	resolvConf *dns.ClientConfig
+	hosts      *hostsFile
+	logger     *zapctx.Logger
+	// Metrics is optional and counts lookup failures per resolver
+	Metrics *metrics.Metrics
+
+	// now defaults to time.Now
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// NewMultiResolver makes a resolver that tries each DNS server, as described by NewServerResolver, until one answers.
+// Like the operating system's resolver, names are looked up in the hosts file first and expanded with the search
+// domains of resolv.conf.  No servers uses the nameservers of resolv.conf, or the operating system's resolver if it
+// has none.
+func NewMultiResolver(logger *zapctx.Logger, dnsServers []string, opts ServerOptions) (*MultiResolver, error) {
+	ret := &MultiResolver{
+		logger:                 logger,
+		quorum:                 opts.Quorum,
+		failuresBeforeCooldown: opts.FailuresBeforeCooldown,
+		cooldown:               opts.Cooldown,
+		hosts:                  &hostsFile{path: opts.HostsFile},
+	}
+	if ret.failuresBeforeCooldown <= 0 {
+		ret.failuresBeforeCooldown = defaultFailuresBeforeCooldown
+	}
+	if ret.cooldown <= 0 {
+		ret.cooldown = defaultCooldown
+	}
+	if ret.hosts.path == "" {
+		ret.hosts.path = defaultHostsFile
+	}
+	resolvConfPath := opts.ResolvConf
+	if resolvConfPath == "" {
+		resolvConfPath = defaultResolvConf
+	}
+	resolvConf, err := loadResolvConf(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", resolvConfPath, err)
+	}
+	if len(dnsServers) == 0 && (resolvConf == nil || len(resolvConf.Servers) == 0) {
+		logger.Info(context.Background(), "no dns servers in ENV or resolv.conf: using default")
+		ret.coreResolvers = []RecordResolver{netResolver{net.DefaultResolver}}
+		ret.names = []string{systemResolverName}
+		ret.health = []*serverHealth{{}}
+		// The operating system's resolver already searches and reads the hosts file itself
+		return ret, nil
+	}
+	ret.resolvConf = resolvConf
+	if len(dnsServers) == 0 {
+		logger.Info(context.Background(), "no dns servers in ENV: using the nameservers of resolv.conf", zap.Strings("servers", resolvConf.Servers))
+		for _, server := range resolvConf.Servers {
+			dnsServers = append(dnsServers, net.JoinHostPort(server, resolvConf.Port))
+		}
+	}
+	for _, dnsServer := range dnsServers {
+		resolver, err := NewServerResolver(dnsServer, opts)
+		if err != nil {
+			return nil, err
+		}
+		ret.coreResolvers = append(ret.coreResolvers, resolver)
+		ret.names = append(ret.names, dnsServer)
+		ret.health = append(ret.health, &serverHealth{})
+	}
+	return ret, nil
+}
+
+func withDefaultPort(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+func (m *MultiResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ans, err := m.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Addrs, nil
+}
+
+func (m *MultiResolver) Resolve(ctx context.Context, host string) (*Answer, error) {
+	if m.hosts != nil {
+		if addrs := inFamily(ctx, m.hosts.lookup(host)); len(addrs) > 0 {
+			return &Answer{Addrs: addrs, Server: hostsFileServerName}, nil
+		}
+	}
+	var err error
+	for _, name := range nameList(m.resolvConf, host) {
+		var ans *Answer
+		ans, err = m.resolveName(ctx, name)
+		// Like the operating system's resolver, only a name that does not exist moves on to the next
+		if !isNotFound(err) {
+			return ans, err
+		}
+	}
+	return nil, err
+}
+
+// isNotFound returns true if err is a DNS server saying a name does not exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// resolveName looks up a single name, without the hosts file or search domains
+func (m *MultiResolver) resolveName(ctx context.Context, host string) (*Answer, error) {
+	logger := m.logger.With(zap.String("host", host))
+	logger.Debug(ctx, "starting lookup")
+	if m.quorum != QuorumFirst && len(m.coreResolvers) > 1 {
+		return m.resolveQuorum(ctx, logger, host)
+	}
+	var lastErr error
+	for _, resolverIdx := range m.order() {
+		var ans *Answer
+		start := m.currentTime()
+		ans, lastErr = m.coreResolvers[resolverIdx].Resolve(ctx, host)
+		m.record(ctx, resolverIdx, start, lastErr)
+		if lastErr == nil {
+			return ans, nil
+		}
+		logger.IfErr(lastErr).Warn(ctx, "unable to look up host", zap.Int("resolver_index", resolverIdx))
+		m.Metrics.DNSLookupFailed(strconv.Itoa(resolverIdx))
+	}
+	logger.IfErr(lastErr).Warn(ctx, "unable to find any resolution for host")
+	return nil, fmt.Errorf("unable to resolve %s: %w", host, lastErr)
+}
+
+// resolveQuorum asks every healthy resolver at once and combines their answers.  Resolvers that fail do not vote.  If
+// every resolver is unhealthy, they are all asked anyway.
+func (m *MultiResolver) resolveQuorum(ctx context.Context, logger *zapctx.Logger, host string) (*Answer, error) {
+	order := m.order()
+	if healthy := m.healthyCount(order); healthy > 0 {
+		order = order[:healthy]
+	}
+	sort.Ints(order)
+	answers := make([]*Answer, len(m.coreResolvers))
+	errs := make([]error, len(m.coreResolvers))
+	var wg sync.WaitGroup
+	for _, i := range order {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := m.currentTime()
+			answers[i], errs[i] = m.coreResolvers[i].Resolve(ctx, host)
+			m.record(ctx, i, start, errs[i])
+		}(i)
+	}
+	wg.Wait()
+	var answered []*Answer
+	var lastErr error
+	for _, i := range order {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			logger.IfErr(lastErr).Warn(ctx, "unable to look up host", zap.Int("resolver_index", i))
+			m.Metrics.DNSLookupFailed(strconv.Itoa(i))
+			continue
+		}
+		answered = append(answered, answers[i])
+	}
+	if len(answered) == 0 {
+		logger.IfErr(lastErr).Warn(ctx, "unable to find any resolution for host")
+		return nil, fmt.Errorf("unable to resolve %s: %w", host, lastErr)
+	}
+	if !answersAgree(answered) {
+		byServer := make(map[string][]string, len(answered))
+		for i, ans := range answered {
+			server := ans.Server
+			if server == "" {
+				server = strconv.Itoa(i)
+			}
+			byServer[server] = addrStrings(ans.Addrs)
+		}
+		logger.Warn(ctx, "DNS servers disagree", zap.String("quorum", string(m.quorum)), zap.Any("answers", byServer))
+		m.Metrics.DNSDisagreement(string(m.quorum))
+	}
+	ret := combineAnswers(m.quorum, answered)
+	if len(ret.Addrs) == 0 {
+		return nil, fmt.Errorf("unable to resolve %s: no addresses reached %s quorum of %d answers", host, m.quorum, len(answered))
+	}
+	return ret, nil
+}
+
+// combineAnswers keeps the addresses returned by enough answers for quorum, in the order they were first returned
+func combineAnswers(quorum Quorum, answers []*Answer) *Answer {
+	needed := 1
+	switch quorum {
+	case QuorumIntersection:
+		needed = len(answers)
+	case QuorumMajority:
+		needed = len(answers)/2 + 1
+	}
+	votes := make(map[string]int)
+	var order []net.IPAddr
+	var ret Answer
+	var servers []string
+	// The chain is only unknown if no answer knows it
+	ret.ChainUnknown = true
+	for _, ans := range answers {
+		ret.TTL = minTTL(ret.TTL, ans.TTL)
+		if len(ret.Chain) == 0 {
+			ret.Chain = ans.Chain
+		}
+		ret.ChainUnknown = ret.ChainUnknown && ans.ChainUnknown
+		if ans.Server != "" {
+			servers = append(servers, ans.Server)
+		}
+		// An answer listing an address twice still only votes once
+		seen := make(map[string]struct{}, len(ans.Addrs))
+		for _, addr := range ans.Addrs {
+			key := addr.IP.String()
+			if _, exists := seen[key]; exists {
+				continue
+			}
+			seen[key] = struct{}{}
+			if votes[key] == 0 {
+				order = append(order, addr)
+			}
+			votes[key]++
+		}
+	}
+	for _, addr := range order {
+		if votes[addr.IP.String()] >= needed {
+			ret.Addrs = append(ret.Addrs, addr)
+		}
+	}
+	ret.Server = strings.Join(servers, ",")
+	return &ret
+}
+
+// answersAgree returns true if every answer has the same set of addresses
+func answersAgree(answers []*Answer) bool {
+	first := addrStrings(answers[0].Addrs)
+	for _, ans := range answers[1:] {
+		other := addrStrings(ans.Addrs)
+		if len(other) != len(first) {
+			return false
+		}
+		for i := range first {
+			if first[i] != other[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addrStrings returns the sorted, unique addresses of addrs
+func addrStrings(addrs []net.IPAddr) []string {
+	seen := make(map[string]struct{}, len(addrs))
+	ret := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		key := addr.IP.String()
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (m *MultiResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	return lookupSRVAnswer(ctx, m, service, proto, name)
+}
+
+// ResolveSRV looks up the SRV records of name, trying each search domain like Resolve
+func (m *MultiResolver) ResolveSRV(ctx context.Context, name string) (*SRVAnswer, error) {
+	var ans *SRVAnswer
+	var err error
+	for _, candidate := range nameList(m.resolvConf, name) {
+		ans, err = m.resolveSRVName(ctx, candidate)
+		if !isNotFound(err) {
+			return ans, err
+		}
+	}
+	return nil, err
+}
+
+// resolveSRVName looks up the SRV records of a single name, without search domains
+func (m *MultiResolver) resolveSRVName(ctx context.Context, name string) (*SRVAnswer, error) {
+	logger := m.logger.With(zap.String("name", name))
+	var lastErr error
+	for _, resolverIdx := range m.order() {
+		srvResolver, ok := m.coreResolvers[resolverIdx].(SRVResolver)
+		if !ok {
+			continue
+		}
+		start := m.currentTime()
+		var ans *SRVAnswer
+		ans, lastErr = resolveSRVWith(ctx, srvResolver, name)
+		m.record(ctx, resolverIdx, start, lastErr)
+		if lastErr == nil {
+			return ans, nil
+		}
+		logger.IfErr(lastErr).Warn(ctx, "unable to look up SRV records", zap.Int("resolver_index", resolverIdx))
+		m.Metrics.DNSLookupFailed(strconv.Itoa(resolverIdx))
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no resolver can look up SRV records")
+	}
+	return nil, fmt.Errorf("unable to look up SRV records for %s: %w", name, lastErr)
+}
+
+var _ RecordResolver = &MultiResolver{}
+
+var _ SRVRecordResolver = &MultiResolver{}
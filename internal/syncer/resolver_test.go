@@ -0,0 +1,332 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// startDNSServer serves records from zone on a local UDP port and returns its address
+func startDNSServer(t *testing.T, zone map[uint16][]dns.RR) string {
+	return startDNSHandler(t, func(r *dns.Msg) *dns.Msg {
+		return answerFromZone(zone, r)
+	})
+}
+
+// startDNSHandler answers queries with handler on a local UDP port and returns its address
+func startDNSHandler(t *testing.T, handler func(r *dns.Msg) *dns.Msg) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			_ = w.WriteMsg(handler(r))
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+// answerFromZone answers a query from the records of zone
+func answerFromZone(zone map[uint16][]dns.RR, r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	// Follow CNAMEs like a recursive resolver would
+	name := r.Question[0].Name
+	for _, rr := range zone[r.Question[0].Qtype] {
+		if rr.Header().Name != name {
+			continue
+		}
+		m.Answer = append(m.Answer, rr)
+		if cname, ok := rr.(*dns.CNAME); ok {
+			name = cname.Target
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Rcode = dns.RcodeNameError
+	}
+	return m
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func TestDNSServerResolver(t *testing.T) {
+	addr := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.example.com. 300 IN CNAME lb.example.com."),
+			mustRR(t, "lb.example.com. 60 IN A 1.2.3.4"),
+			mustRR(t, "lb.example.com. 60 IN A 1.2.3.5"),
+			mustRR(t, "v4.example.com. 120 IN A 1.2.3.6"),
+		},
+		dns.TypeAAAA: {
+			mustRR(t, "www.example.com. 300 IN CNAME lb.example.com."),
+			mustRR(t, "lb.example.com. 30 IN AAAA 2001:db8::1"),
+		},
+	})
+	r := &DNSServerResolver{
+		Server:  addr,
+		Timeout: time.Second,
+	}
+	ctx := context.Background()
+
+	ans, err := r.Resolve(ctx, "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, time.Second*30, ans.TTL)
+	require.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5", "2001:db8::1"}, ipStrings(ans.Addrs))
+	require.Equal(t, []string{"lb.example.com"}, ans.Chain)
+
+	ans, err = r.Resolve(ctx, "v4.example.com")
+	require.NoError(t, err)
+	require.Equal(t, time.Second*120, ans.TTL)
+	require.Equal(t, []string{"1.2.3.6"}, ipStrings(ans.Addrs))
+	require.Empty(t, ans.Chain)
+
+	_, err = r.Resolve(ctx, "missing.example.com")
+	var dnsErr *net.DNSError
+	require.True(t, errors.As(err, &dnsErr))
+	require.True(t, dnsErr.IsNotFound)
+}
+
+func TestMultiResolverReportsTTL(t *testing.T) {
+	addr := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "www.example.com. 45 IN A 1.2.3.4"),
+		},
+	})
+	m, err := NewMultiResolver(nil, []string{addr}, ServerOptions{})
+	require.NoError(t, err)
+	ans, err := m.Resolve(context.Background(), "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, time.Second*45, ans.TTL)
+	ips, err := m.LookupIPAddr(context.Background(), "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4"}, ipStrings(ips))
+}
+
+func ipStrings(addrs []net.IPAddr) []string {
+	ret := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		ret = append(ret, a.IP.String())
+	}
+	return ret
+}
+
+func TestSyncSingleMappingDNSServers(t *testing.T) {
+	addr := startDNSServer(t, map[uint16][]dns.RR{
+		dns.TypeA: {
+			mustRR(t, "internal.example.com. 60 IN A 10.0.0.5"),
+		},
+	})
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("10.0.0.9")},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration: 1,
+			RemoveUnknownTgIP:               true,
+		},
+		Resolver: staticResolver{},
+	}
+	keep := false
+	plan, err := s.syncSingle(context.Background(), "arn:test", state.Mapping{
+		Hostnames:         []string{"internal.example.com"},
+		DNSServers:        []string{addr},
+		RemoveUnknownTgIP: &keep,
+	}, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.5"}, plan.ToAdd)
+	require.Empty(t, plan.ToRemove, "the mapping keeps unknown targets")
+	require.Equal(t, time.Second*60, plan.TTL)
+	require.Equal(t, []string{addr}, plan.Resolvers)
+}
+
+func TestPreferredSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "a.", Priority: 10, Weight: 5},
+		{Target: "b.", Priority: 10, Weight: 0},
+		{Target: "c.", Priority: 20, Weight: 5},
+		{Target: "d.", Priority: 10, Weight: 1},
+	}
+	require.Equal(t, []*net.SRV{records[0], records[3]}, preferredSRV(records))
+	zeroWeights := []*net.SRV{
+		{Target: "a.", Priority: 10},
+		{Target: "b.", Priority: 10},
+	}
+	require.Equal(t, zeroWeights, preferredSRV(zeroWeights), "zero weights are only skipped when there is a choice")
+	require.Empty(t, preferredSRV(nil))
+}
+
+func TestSyncSingleSRV(t *testing.T) {
+	zone := map[uint16][]dns.RR{
+		dns.TypeSRV: {
+			mustRR(t, "_http._tcp.web.example.com. 30 IN SRV 10 5 8080 a.example.com."),
+			mustRR(t, "_http._tcp.web.example.com. 10 IN SRV 10 5 8081 a.example.com."),
+			mustRR(t, "_http._tcp.web.example.com. 30 IN SRV 10 5 9000 b.example.com."),
+			mustRR(t, "_http._tcp.web.example.com. 30 IN SRV 20 5 9999 backup.example.com."),
+		},
+		dns.TypeA: {
+			mustRR(t, "a.example.com. 60 IN A 10.0.0.1"),
+			mustRR(t, "b.example.com. 20 IN A 10.0.0.2"),
+			mustRR(t, "backup.example.com. 60 IN A 10.0.0.3"),
+		},
+	}
+	resolver, err := NewMultiResolver(testhelp.ZapTestingLogger(t), []string{startDNSServer(t, zone)}, ServerOptions{})
+	require.NoError(t, err)
+	ans, err := resolver.ResolveSRV(context.Background(), "_http._tcp.web.example.com")
+	require.NoError(t, err)
+	require.Len(t, ans.Records, 4)
+	require.Equal(t, time.Second*10, ans.TTL)
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("10.0.0.1"), Port: aws.Int64(8080)},
+			{Id: aws.String("10.0.0.1"), Port: aws.Int64(7000)},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration: 1,
+			RemoveUnknownTgIP:               true,
+		},
+		Resolver: resolver,
+	}
+	mapping := state.Mapping{Hostnames: []string{"srv:_http._tcp.web.example.com"}}
+	plan, err := s.syncSingle(context.Background(), "arn:test", mapping, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:8081", "10.0.0.2:9000"}, plan.ToAdd)
+	require.Equal(t, []string{"10.0.0.1:7000"}, plan.ToRemove, "targets are compared by port")
+	require.Equal(t, time.Second*10, plan.TTL, "the SRV records' TTL counts too")
+	require.Len(t, client.registered, 2)
+	require.Equal(t, "10.0.0.2", *client.registered[1].Id)
+	require.Equal(t, int64(9000), *client.registered[1].Port)
+	require.Equal(t, []state.Target{
+		{IP: "10.0.0.1", Port: 8080},
+		{IP: "10.0.0.1", Port: 8081},
+		{IP: "10.0.0.2", Port: 9000},
+	}, stripHealth(plan.NewState.Targets))
+
+	// Plain hostnames need a port to compare with SRV targets
+	_, err = s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"a.example.com", "srv:_http._tcp.web.example.com"}}, state.State{})
+	require.Error(t, err)
+	plan, err = s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"b.example.com", "srv:_http._tcp.web.example.com"}, Port: 80}, state.State{})
+	require.NoError(t, err)
+	require.Contains(t, plan.ToAdd, "10.0.0.2:80")
+
+	s.Resolver = staticResolver{}
+	_, err = s.syncSingle(context.Background(), "arn:test", mapping, state.State{})
+	require.Error(t, err, "the resolver cannot look up SRV records")
+}
+
+func stripHealth(targets []state.Target) []state.Target {
+	ret := make([]state.Target, 0, len(targets))
+	for _, t := range targets {
+		t.Health = ""
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func TestParseQuorum(t *testing.T) {
+	for in, expected := range map[string]Quorum{
+		"":              QuorumFirst,
+		"first":         QuorumFirst,
+		"Union":         QuorumUnion,
+		" intersection": QuorumIntersection,
+		"majority":      QuorumMajority,
+	} {
+		q, err := ParseQuorum(in)
+		require.NoError(t, err, in)
+		require.Equal(t, expected, q, in)
+	}
+	_, err := ParseQuorum("most")
+	require.Error(t, err)
+}
+
+func TestMultiResolverQuorum(t *testing.T) {
+	answers := [][]string{
+		{"10.0.0.1", "10.0.0.2"},
+		{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		// A stale server
+		{"10.0.0.1", "10.0.0.9"},
+	}
+	var servers []string
+	for i, ips := range answers {
+		var records []dns.RR
+		for _, ip := range ips {
+			records = append(records, mustRR(t, fmt.Sprintf("www.example.com. %d IN A %s", 60-i*10, ip)))
+		}
+		servers = append(servers, startDNSServer(t, map[uint16][]dns.RR{dns.TypeA: records}))
+	}
+	ctx := context.Background()
+	for quorum, expected := range map[Quorum][]string{
+		QuorumUnion:        {"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.9"},
+		QuorumIntersection: {"10.0.0.1"},
+		QuorumMajority:     {"10.0.0.1", "10.0.0.2"},
+	} {
+		reg := prometheus.NewRegistry()
+		m, err := NewMultiResolver(testhelp.ZapTestingLogger(t), servers, ServerOptions{Quorum: quorum})
+		require.NoError(t, err)
+		m.Metrics, err = metrics.New(reg)
+		require.NoError(t, err)
+		ans, err := m.Resolve(ctx, "www.example.com")
+		require.NoError(t, err, quorum)
+		require.ElementsMatch(t, expected, ipStrings(ans.Addrs), quorum)
+		require.Equal(t, time.Second*40, ans.TTL, "the shortest TTL of every answer")
+		require.ElementsMatch(t, servers, strings.Split(ans.Server, ","))
+		count, err := testutil.GatherAndCount(reg, "hostname_for_target_group_dns_disagreements_total")
+		require.NoError(t, err)
+		require.Equal(t, 1, count, "disagreements are counted")
+	}
+
+	// Servers that agree are not a disagreement, and servers that fail do not vote
+	agreeing := []string{servers[0], servers[0], "127.0.0.1:1"}
+	reg := prometheus.NewRegistry()
+	m, err := NewMultiResolver(testhelp.ZapTestingLogger(t), agreeing, ServerOptions{Quorum: QuorumIntersection, Timeout: time.Millisecond * 200})
+	require.NoError(t, err)
+	m.Metrics, err = metrics.New(reg)
+	require.NoError(t, err)
+	ans, err := m.Resolve(ctx, "www.example.com")
+	require.NoError(t, err)
+	require.ElementsMatch(t, answers[0], ipStrings(ans.Addrs))
+	count, err := testutil.GatherAndCount(reg, "hostname_for_target_group_dns_disagreements_total")
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// No address in common is an error rather than an empty answer
+	disjoint := startDNSServer(t, map[uint16][]dns.RR{dns.TypeA: {mustRR(t, "www.example.com. 60 IN A 10.0.0.5")}})
+	m, err = NewMultiResolver(testhelp.ZapTestingLogger(t), []string{servers[0], disjoint}, ServerOptions{Quorum: QuorumIntersection})
+	require.NoError(t, err)
+	_, err = m.Resolve(ctx, "www.example.com")
+	require.Error(t, err)
+}
@@ -0,0 +1,165 @@
+package syncer
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultFailuresBeforeCooldown is how many lookups in a row a server can fail before it is skipped
+	defaultFailuresBeforeCooldown = 3
+	// defaultCooldown is how long a failing server is skipped
+	defaultCooldown = time.Second * 30
+	// healthSmoothing is the weight of the newest lookup in a server's average latency and error rate
+	healthSmoothing = 0.3
+)
+
+// serverHealth tracks recent lookups against one of a MultiResolver's servers
+type serverHealth struct {
+	// latency is a moving average of how long lookups take
+	latency time.Duration
+	// errorRate is a moving average of failed lookups, from 0 to 1
+	errorRate           float64
+	lookups             int64
+	failures            int64
+	consecutiveFailures int
+	// unhealthyUntil is when a server that failed too many lookups in a row may be tried again
+	unhealthyUntil time.Time
+	lastError      string
+}
+
+// ServerStatus is the health of one of a MultiResolver's servers
+type ServerStatus struct {
+	Server  string `json:"server"`
+	Healthy bool   `json:"healthy"`
+	// UnhealthyUntil is when an unhealthy server is next tried
+	UnhealthyUntil *time.Time `json:"unhealthyUntil,omitempty"`
+	// LatencyMillis is a moving average of lookup latency
+	LatencyMillis float64 `json:"latencyMillis"`
+	// ErrorRate is a moving average of failed lookups, from 0 to 1
+	ErrorRate           float64 `json:"errorRate"`
+	Lookups             int64   `json:"lookups"`
+	Failures            int64   `json:"failures"`
+	ConsecutiveFailures int     `json:"consecutiveFailures"`
+	LastError           string  `json:"lastError,omitempty"`
+}
+
+// isServerFailure returns false for errors that are a working server's answer, like a host not existing
+func isServerFailure(err error) bool {
+	return !isNotFound(err)
+}
+
+func (m *MultiResolver) currentTime() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// order returns the indexes of the resolvers to try: healthy ones fastest first, then unhealthy ones that will be
+// healthy soonest
+func (m *MultiResolver) order() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.currentTime()
+	var healthy, unhealthy []int
+	// Start from a random resolver, so resolvers that are equally fast share lookups
+	idx := rand.Intn(len(m.coreResolvers))
+	for i := 0; i < len(m.coreResolvers); i++ {
+		resolverIdx := (idx + i) % len(m.coreResolvers)
+		if now.Before(m.health[resolverIdx].unhealthyUntil) {
+			unhealthy = append(unhealthy, resolverIdx)
+		} else {
+			healthy = append(healthy, resolverIdx)
+		}
+	}
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return m.health[healthy[i]].latency < m.health[healthy[j]].latency
+	})
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return m.health[unhealthy[i]].unhealthyUntil.Before(m.health[unhealthy[j]].unhealthyUntil)
+	})
+	return append(healthy, unhealthy...)
+}
+
+// healthyCount returns how many resolvers of order are healthy.  order puts them first.
+func (m *MultiResolver) healthyCount(order []int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.currentTime()
+	ret := 0
+	for _, idx := range order {
+		if !now.Before(m.health[idx].unhealthyUntil) {
+			ret++
+		}
+	}
+	return ret
+}
+
+// record updates the health of a resolver after a lookup that started at start.  Lookups cut off by ctx, like a
+// target group running out of sync time, say nothing about the server and are not counted.
+func (m *MultiResolver) record(ctx context.Context, resolverIdx int, start time.Time, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.currentTime()
+	h := m.health[resolverIdx]
+	h.lookups++
+	failed := 0.0
+	if err != nil && isServerFailure(err) {
+		failed = 1
+		h.failures++
+		h.consecutiveFailures++
+		h.lastError = err.Error()
+		if h.consecutiveFailures >= m.failuresBeforeCooldown && !now.Before(h.unhealthyUntil) {
+			h.unhealthyUntil = now.Add(m.cooldown)
+			m.logger.Warn(ctx, "skipping failing DNS server", zap.String("server", m.names[resolverIdx]), zap.Int("consecutive_failures", h.consecutiveFailures), zap.Duration("cooldown", m.cooldown))
+		}
+	} else {
+		if !h.unhealthyUntil.IsZero() {
+			m.logger.Info(ctx, "DNS server recovered", zap.String("server", m.names[resolverIdx]))
+		}
+		h.consecutiveFailures = 0
+		h.unhealthyUntil = time.Time{}
+	}
+	latency := now.Sub(start)
+	if h.lookups == 1 {
+		h.latency = latency
+		h.errorRate = failed
+		return
+	}
+	h.latency = time.Duration(healthSmoothing*float64(latency) + (1-healthSmoothing)*float64(h.latency))
+	h.errorRate = healthSmoothing*failed + (1-healthSmoothing)*h.errorRate
+}
+
+// ServerStatus returns the health of each server, in the order they were configured
+func (m *MultiResolver) ServerStatus() []ServerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.currentTime()
+	ret := make([]ServerStatus, 0, len(m.health))
+	for i, h := range m.health {
+		status := ServerStatus{
+			Server:              m.names[i],
+			Healthy:             !now.Before(h.unhealthyUntil),
+			LatencyMillis:       float64(h.latency) / float64(time.Millisecond),
+			ErrorRate:           h.errorRate,
+			Lookups:             h.lookups,
+			Failures:            h.failures,
+			ConsecutiveFailures: h.consecutiveFailures,
+			LastError:           h.lastError,
+		}
+		if !status.Healthy {
+			until := h.unhealthyUntil
+			status.UnhealthyUntil = &until
+		}
+		ret = append(ret, status)
+	}
+	return ret
+}
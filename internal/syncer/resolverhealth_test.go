@@ -0,0 +1,202 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer answers lookups after advancing a fake clock by its delay.  Servers with a delay are not safe to use in a
+// quorum.
+type fakeServer struct {
+	now   *time.Time
+	delay time.Duration
+	err   error
+	calls int
+}
+
+func (f *fakeServer) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ans, err := f.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Addrs, nil
+}
+
+func (f *fakeServer) Resolve(_ context.Context, _ string) (*Answer, error) {
+	f.calls++
+	if f.delay != 0 {
+		*f.now = f.now.Add(f.delay)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &Answer{Addrs: []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}}, nil
+}
+
+func newTestMultiResolver(t *testing.T, now *time.Time, servers ...*fakeServer) *MultiResolver {
+	m := &MultiResolver{
+		logger:                 testhelp.ZapTestingLogger(t),
+		failuresBeforeCooldown: defaultFailuresBeforeCooldown,
+		cooldown:               defaultCooldown,
+		now: func() time.Time {
+			return *now
+		},
+	}
+	for i, s := range servers {
+		s.now = now
+		m.coreResolvers = append(m.coreResolvers, s)
+		m.names = append(m.names, fmt.Sprintf("server%d", i))
+		m.health = append(m.health, &serverHealth{})
+	}
+	return m
+}
+
+func TestMultiResolverPrefersFastest(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	slow := &fakeServer{delay: time.Millisecond * 50}
+	fast := &fakeServer{delay: time.Millisecond * 10}
+	m := newTestMultiResolver(t, &now, slow, fast)
+	ctx := context.Background()
+	// Servers without a latency yet are tried first, so both are measured
+	for i := 0; i < 2; i++ {
+		_, err := m.Resolve(ctx, "www.example.com")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, slow.calls)
+	require.Equal(t, 1, fast.calls)
+	for i := 0; i < 5; i++ {
+		_, err := m.Resolve(ctx, "www.example.com")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, slow.calls)
+	require.Equal(t, 6, fast.calls)
+
+	status := m.ServerStatus()
+	require.Equal(t, "server0", status[0].Server)
+	require.Equal(t, 50.0, status[0].LatencyMillis)
+	require.Equal(t, 10.0, status[1].LatencyMillis)
+	require.True(t, status[0].Healthy)
+}
+
+func TestMultiResolverCooldown(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	failing := &fakeServer{err: errors.New("i/o timeout")}
+	working := &fakeServer{}
+	m := newTestMultiResolver(t, &now, failing, working)
+	m.health[1].latency = time.Millisecond * 10
+	m.health[1].lookups = 1
+	ctx := context.Background()
+	resolve := func() {
+		_, err := m.Resolve(ctx, "www.example.com")
+		require.NoError(t, err, "the working server always answers")
+	}
+	// The failing server is faster, so it is tried first until it trips
+	for i := 0; i < defaultFailuresBeforeCooldown; i++ {
+		resolve()
+	}
+	require.Equal(t, defaultFailuresBeforeCooldown, failing.calls)
+	status := m.ServerStatus()
+	require.False(t, status[0].Healthy)
+	require.Equal(t, now.Add(defaultCooldown), *status[0].UnhealthyUntil)
+	require.Equal(t, int64(3), status[0].Failures)
+	require.Equal(t, 3, status[0].ConsecutiveFailures)
+	require.Equal(t, 1.0, status[0].ErrorRate)
+	require.Equal(t, "i/o timeout", status[0].LastError)
+
+	resolve()
+	resolve()
+	require.Equal(t, defaultFailuresBeforeCooldown, failing.calls, "skipped during the cooldown")
+
+	// After the cooldown, one more failure trips it again
+	now = now.Add(defaultCooldown)
+	resolve()
+	require.Equal(t, defaultFailuresBeforeCooldown+1, failing.calls)
+	require.False(t, m.ServerStatus()[0].Healthy)
+	resolve()
+	require.Equal(t, defaultFailuresBeforeCooldown+1, failing.calls)
+
+	failing.err = nil
+	now = now.Add(defaultCooldown)
+	resolve()
+	status = m.ServerStatus()
+	require.True(t, status[0].Healthy)
+	require.Nil(t, status[0].UnhealthyUntil)
+	require.Equal(t, 0, status[0].ConsecutiveFailures)
+	require.Less(t, status[0].ErrorRate, 1.0)
+}
+
+func TestMultiResolverAllUnhealthy(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	a := &fakeServer{err: errors.New("i/o timeout")}
+	b := &fakeServer{err: errors.New("i/o timeout")}
+	m := newTestMultiResolver(t, &now, a, b)
+	for i := 0; i < defaultFailuresBeforeCooldown+1; i++ {
+		_, err := m.Resolve(context.Background(), "www.example.com")
+		require.Error(t, err)
+	}
+	require.Equal(t, defaultFailuresBeforeCooldown+1, a.calls, "unhealthy servers are still tried when no server is healthy")
+	require.Equal(t, defaultFailuresBeforeCooldown+1, b.calls)
+
+	b.err = nil
+	m.quorum = QuorumUnion
+	ans, err := m.Resolve(context.Background(), "www.example.com")
+	require.NoError(t, err)
+	require.Len(t, ans.Addrs, 1)
+	require.True(t, m.ServerStatus()[1].Healthy)
+	_, err = m.Resolve(context.Background(), "www.example.com")
+	require.NoError(t, err)
+	require.Equal(t, defaultFailuresBeforeCooldown+2, a.calls, "quorums skip unhealthy servers once one is healthy")
+}
+
+func TestMultiResolverNotFoundIsHealthy(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	missing := &fakeServer{err: &net.DNSError{Err: "no such host", IsNotFound: true}}
+	m := newTestMultiResolver(t, &now, missing)
+	for i := 0; i < defaultFailuresBeforeCooldown*2; i++ {
+		_, err := m.Resolve(context.Background(), "missing.example.com")
+		require.Error(t, err)
+	}
+	status := m.ServerStatus()
+	require.True(t, status[0].Healthy)
+	require.Equal(t, int64(0), status[0].Failures)
+	require.Equal(t, int64(defaultFailuresBeforeCooldown*2), status[0].Lookups)
+}
+
+func TestMultiResolverCanceledIsHealthy(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	cutOff := &fakeServer{err: &net.DNSError{Err: "context deadline exceeded"}}
+	m := newTestMultiResolver(t, &now, cutOff)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < defaultFailuresBeforeCooldown*2; i++ {
+		_, err := m.Resolve(ctx, "www.example.com")
+		require.Error(t, err)
+	}
+	status := m.ServerStatus()
+	require.True(t, status[0].Healthy, "the lookups were cut off, not failed by the server")
+	require.Equal(t, int64(0), status[0].Failures)
+	require.Equal(t, int64(0), status[0].Lookups)
+}
+
+func TestSyncerResolverStatus(t *testing.T) {
+	resolver, err := NewMultiResolver(nil, []string{"10.0.0.2"}, ServerOptions{})
+	require.NoError(t, err)
+	s := &Syncer{
+		Resolver: resolver,
+	}
+	_, err = s.resolverFor(state.Mapping{DNSServers: []string{"10.0.0.3", "tls://10.0.0.4"}})
+	require.NoError(t, err)
+	status := s.ResolverStatus()
+	require.Len(t, status, 2)
+	require.Equal(t, "10.0.0.2", status[defaultResolverName][0].Server)
+	require.Len(t, status["10.0.0.3,tls://10.0.0.4"], 2)
+	require.True(t, status["10.0.0.3,tls://10.0.0.4"][1].Healthy)
+}
@@ -0,0 +1,63 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"go.uber.org/zap"
+)
+
+// SyncDue syncs only the target groups whose DNS answers may have changed.  Each target group is due again after the
+// shortest TTL of its hostnames, bounded by Config.MinRefreshInterval and Config.MaxRefreshInterval.  Target groups
+// that have never synced are always due.
+func (s *Syncer) SyncDue(ctx context.Context) error {
+	toSyncMap, err := s.SyncFinder.ToSync(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get tg to sync: %w", err)
+	}
+	now := time.Now()
+	due := make(map[state.TargetGroupARN]state.Mapping, len(toSyncMap))
+	s.mu.Lock()
+	for tgArn, mapping := range toSyncMap {
+		if next, exists := s.nextSync[tgArn]; !exists || !now.Before(next) {
+			due[tgArn] = mapping
+		}
+	}
+	// Forget target groups that are no longer synced
+	for tgArn := range s.nextSync {
+		if _, exists := toSyncMap[tgArn]; !exists {
+			delete(s.nextSync, tgArn)
+		}
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return nil
+	}
+	s.Log.Debug(ctx, "syncing due target groups", zap.Int("due", len(due)), zap.Int("total", len(toSyncMap)))
+	return s.syncMappings(ctx, due)
+}
+
+func (s *Syncer) scheduleNext(targetGroupARN state.TargetGroupARN, ttl time.Duration, syncErr error) {
+	next := time.Now().Add(s.refreshInterval(ttl, syncErr))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextSync == nil {
+		s.nextSync = make(map[state.TargetGroupARN]time.Time)
+	}
+	s.nextSync[targetGroupARN] = next
+}
+
+func (s *Syncer) refreshInterval(ttl time.Duration, syncErr error) time.Duration {
+	if syncErr != nil || ttl == 0 {
+		return s.Config.MinRefreshInterval
+	}
+	if ttl < s.Config.MinRefreshInterval {
+		return s.Config.MinRefreshInterval
+	}
+	if s.Config.MaxRefreshInterval > 0 && ttl > s.Config.MaxRefreshInterval {
+		return s.Config.MaxRefreshInterval
+	}
+	return ttl
+}
@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// ttlResolver answers from a fixed table, reporting a TTL with each answer
+type ttlResolver map[string]Answer
+
+func (t ttlResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ans, err := t.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Addrs, nil
+}
+
+func (t ttlResolver) Resolve(_ context.Context, host string) (*Answer, error) {
+	ans, exists := t[host]
+	if !exists {
+		return nil, errors.New("no such host")
+	}
+	return &ans, nil
+}
+
+func TestSyncDue(t *testing.T) {
+	client := &fakeELB{}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		State:  &memoryStorage{},
+		Config: Config{
+			MinRefreshInterval: time.Second,
+			MaxRefreshInterval: time.Hour,
+		},
+		Resolver: ttlResolver{
+			"short.example.com": {Addrs: ipAddrs("1.2.3.4"), TTL: time.Millisecond},
+			"long.example.com":  {Addrs: ipAddrs("1.2.3.5"), TTL: time.Minute},
+		},
+		SyncFinder: staticSyncFinder{
+			"arn:short": {Hostnames: []string{"short.example.com"}},
+			"arn:long":  {Hostnames: []string{"long.example.com", "short.example.com"}},
+			"arn:fail":  {Hostnames: []string{"missing.example.com"}},
+		},
+	}
+	before := time.Now()
+	require.NoError(t, s.SyncDue(context.Background()))
+	require.Len(t, client.registered, 3)
+
+	// The shortest TTL of a target group's hostnames wins, bounded by the minimum interval.  Failures retry soon.
+	require.WithinDuration(t, before.Add(time.Second), s.nextSync["arn:short"], time.Second/2)
+	require.WithinDuration(t, before.Add(time.Second), s.nextSync["arn:long"], time.Second/2)
+	require.WithinDuration(t, before.Add(time.Second), s.nextSync["arn:fail"], time.Second/2)
+
+	s.Config.MinRefreshInterval = 0
+	s.Resolver = ttlResolver{
+		"short.example.com": {Addrs: ipAddrs("1.2.3.4"), TTL: time.Minute},
+		"long.example.com":  {Addrs: ipAddrs("1.2.3.5"), TTL: time.Hour * 2},
+	}
+	s.nextSync["arn:short"] = time.Now().Add(-time.Second)
+	s.nextSync["arn:long"] = time.Now().Add(time.Minute)
+	delete(s.SyncFinder.(staticSyncFinder), "arn:fail")
+	require.NoError(t, s.SyncDue(context.Background()))
+	require.Len(t, client.registered, 4, "only arn:short was due")
+	require.WithinDuration(t, time.Now().Add(time.Minute), s.nextSync["arn:short"], time.Second)
+	require.WithinDuration(t, time.Now().Add(time.Minute), s.nextSync["arn:long"], time.Second, "not yet due")
+	require.NotContains(t, s.nextSync, state.TargetGroupARN("arn:fail"))
+}
+
+func TestRefreshInterval(t *testing.T) {
+	s := &Syncer{
+		Config: Config{
+			MinRefreshInterval: time.Second * 5,
+			MaxRefreshInterval: time.Minute * 5,
+		},
+	}
+	require.Equal(t, time.Second*30, s.refreshInterval(time.Second*30, nil))
+	require.Equal(t, time.Second*5, s.refreshInterval(time.Second, nil))
+	require.Equal(t, time.Minute*5, s.refreshInterval(time.Hour, nil))
+	require.Equal(t, time.Second*5, s.refreshInterval(0, nil), "unknown TTL")
+	require.Equal(t, time.Second*5, s.refreshInterval(time.Minute, errors.New("failed")))
+}
@@ -0,0 +1,65 @@
+package syncer
+
+import (
+	"github.com/cresta/hostname-for-target-group/internal/state"
+)
+
+// shrinkLimitHold returns the removals to hold so a single sync removes no more of a target group's currentCount
+// targets than Config.MaxRemovalCount or Config.MaxRemovalPercent allow.  A resolver that answers with too few IPs
+// looks exactly like hosts going away, so a large shrink is spread over several syncs, giving a DNS problem time to
+// clear before it empties the target group.  At least one target is removed per sync, so small target groups still
+// shrink.
+func (c Config) shrinkLimitHold(currentCount int, toRemove []string) []string {
+	allowed := len(toRemove)
+	if c.MaxRemovalCount > 0 && c.MaxRemovalCount < allowed {
+		allowed = c.MaxRemovalCount
+	}
+	if c.MaxRemovalPercent > 0 {
+		byPercent := int(c.MaxRemovalPercent * float64(currentCount) / 100)
+		if byPercent < 1 {
+			byPercent = 1
+		}
+		if byPercent < allowed {
+			allowed = byPercent
+		}
+	}
+	return toRemove[:len(toRemove)-allowed]
+}
+
+// minTargetsHold returns the removals to hold so an empty DNS answer never takes a target group below its minimum
+// target floor.  Only empty answers are protected: a shorter, non-empty answer is trusted.
+func (c Config) minTargetsHold(resolvedCount int, currentCount int, toRemove []string) []string {
+	floor := c.MinTargets
+	if resolvedCount > 0 || floor <= 0 || len(toRemove) == 0 {
+		return nil
+	}
+	remaining := currentCount - len(toRemove)
+	if remaining >= floor {
+		return nil
+	}
+	toHold := floor - remaining
+	if toHold > len(toRemove) {
+		toHold = len(toRemove)
+	}
+	return toRemove[:toHold]
+}
+
+// holdTargets keeps held targets tracked in newState.  Targets that went missing from DNS are kept at the
+// deregistration threshold, so they are removed by the first sync that is under the limits and they are still missing.
+func holdTargets(newState state.State, held []string, invocationsBeforeDeregistration int) state.State {
+	tracked := targetsToTimesMissed(newState.Targets)
+	for _, key := range held {
+		if _, exists := tracked[key]; exists {
+			// Still tracked, like an unhealthy target DNS returns
+			continue
+		}
+		ip, port := splitTargetKey(key)
+		newState.Targets = append(newState.Targets, state.Target{
+			IP:           ip,
+			Port:         port,
+			TimesMissing: invocationsBeforeDeregistration,
+		})
+	}
+	sortTargets(newState.Targets)
+	return newState
+}
@@ -0,0 +1,154 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShrinkLimitHold(t *testing.T) {
+	c := Config{
+		MaxRemovalCount:   2,
+		MaxRemovalPercent: 50,
+	}
+	require.Empty(t, c.shrinkLimitHold(0, nil))
+	require.Empty(t, c.shrinkLimitHold(4, []string{"a", "b"}))
+	require.Equal(t, []string{"a"}, c.shrinkLimitHold(10, []string{"a", "b", "c"}), "over the count")
+	require.Equal(t, []string{"a"}, c.shrinkLimitHold(3, []string{"a", "b"}), "over the percent")
+	require.Equal(t, []string{"a"}, Config{MaxRemovalPercent: 10}.shrinkLimitHold(2, []string{"a", "b"}), "one target is always removed")
+	require.Empty(t, Config{}.shrinkLimitHold(10, []string{"a", "b"}), "no limits")
+}
+
+func TestSyncSingleHoldsRemovals(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+			{Id: aws.String("1.2.3.6")},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration: 1,
+			RemoveUnknownTgIP:               true,
+			MaxRemovalPercent:               50,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+	}
+	mapping := state.Mapping{Hostnames: []string{"a.example.com"}}
+	plan, err := s.syncSingle(context.Background(), "arn:test", mapping, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.6"}, plan.ToRemove, "removals up to the limit still happen")
+	require.Equal(t, []string{"1.2.3.5"}, plan.HeldRemovals)
+	require.Equal(t, holdReasonShrinkLimit, plan.HoldReason)
+	require.Len(t, client.deregistered, 1)
+	require.Equal(t, []state.Target{
+		{IP: "1.2.3.4"},
+		{IP: "1.2.3.5", TimesMissing: 1},
+	}, stripHealth(plan.NewState.Targets))
+
+	// A held target that DNS returns again is kept
+	client.targets = client.targets[:2]
+	s.Resolver = staticResolver{
+		"a.example.com": ipAddrs("1.2.3.4", "1.2.3.5"),
+	}
+	plan, err = s.syncSingle(context.Background(), "arn:test", mapping, plan.NewState)
+	require.NoError(t, err)
+	require.Empty(t, plan.HeldRemovals)
+	require.Empty(t, plan.ToRemove)
+	require.Len(t, client.deregistered, 1)
+}
+
+func TestSyncShrinksOverSeveralSyncs(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+			{Id: aws.String("1.2.3.6")},
+			{Id: aws.String("1.2.3.7")},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration: 1,
+			RemoveUnknownTgIP:               true,
+			MaxRemovalCount:                 1,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+	}
+	mapping := state.Mapping{Hostnames: []string{"a.example.com"}}
+	var previous state.State
+	for i := 0; i < 3; i++ {
+		plan, err := s.syncSingle(context.Background(), "arn:test", mapping, previous)
+		require.NoError(t, err)
+		require.Len(t, plan.ToRemove, 1, "sync %d", i)
+		require.Len(t, plan.HeldRemovals, 2-i)
+		previous = plan.NewState
+		// fakeELB does not remember deregistrations
+		client.targets = client.targets[:len(client.targets)-1]
+	}
+	require.Len(t, client.deregistered, 3)
+	require.Equal(t, []state.Target{{IP: "1.2.3.4"}}, stripHealth(previous.Targets), "the target group reaches the resolved set")
+}
+
+func TestSyncSingleMinTargets(t *testing.T) {
+	newSyncer := func() (*Syncer, *fakeELB) {
+		client := &fakeELB{
+			targets: []*elbv2.TargetDescription{
+				{Id: aws.String("1.2.3.4")},
+				{Id: aws.String("1.2.3.5")},
+				{Id: aws.String("1.2.3.6")},
+			},
+		}
+		return &Syncer{
+			Log:    testhelp.ZapTestingLogger(t),
+			Client: client,
+			Config: Config{
+				InvocationsBeforeDeregistration: 1,
+				RemoveUnknownTgIP:               true,
+				MinTargets:                      2,
+			},
+			Resolver: staticResolver{
+				"empty.example.com": ipAddrs(),
+				"a.example.com":     ipAddrs("1.2.3.4"),
+			},
+		}, client
+	}
+	s, client := newSyncer()
+	plan, err := s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"empty.example.com"}}, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.6"}, plan.ToRemove)
+	require.Equal(t, []string{"1.2.3.4", "1.2.3.5"}, plan.HeldRemovals)
+	require.Equal(t, holdReasonMinTargets, plan.HoldReason)
+	require.Len(t, client.deregistered, 1)
+
+	// A non-empty answer is trusted
+	s, client = newSyncer()
+	plan, err = s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"a.example.com"}}, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.5", "1.2.3.6"}, plan.ToRemove)
+	require.Empty(t, plan.HeldRemovals)
+	require.Len(t, client.deregistered, 2)
+
+	// The target group's own floor wins
+	s, client = newSyncer()
+	noFloor := 0
+	plan, err = s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"empty.example.com"}, MinTargets: &noFloor}, state.State{})
+	require.NoError(t, err)
+	require.Len(t, plan.ToRemove, 3)
+	require.Empty(t, plan.HeldRemovals)
+	require.Len(t, client.deregistered, 3)
+}
@@ -2,13 +2,21 @@ package syncer
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/cresta/hostname-for-target-group/internal/audit"
+	"github.com/cresta/hostname-for-target-group/internal/metrics"
+	"github.com/cresta/hostname-for-target-group/internal/notify"
 	"github.com/cresta/hostname-for-target-group/internal/state"
 	"github.com/cresta/zapctx"
 	"go.uber.org/zap"
@@ -17,71 +25,91 @@ import (
 type Config struct {
 	InvocationsBeforeDeregistration int
 	RemoveUnknownTgIP               bool
+	// DryRun logs the changes a sync would make without changing target groups or stored state
+	DryRun bool
+	// Concurrency is how many target groups sync at once.  Values below 1 sync one at a time.
+	Concurrency int
+	// TargetGroupTimeout bounds how long syncing a single target group can take.  Zero means no limit.
+	TargetGroupTimeout time.Duration
+	// MinRefreshInterval and MaxRefreshInterval bound how long SyncDue waits to re-sync a target group after its
+	// shortest DNS TTL.  Failed syncs and unknown TTLs retry after MinRefreshInterval.
+	MinRefreshInterval time.Duration
+	MaxRefreshInterval time.Duration
+	// MaxRemovalCount is the most targets a single sync may deregister from a target group.  Zero means no limit.
+	MaxRemovalCount int
+	// MaxRemovalPercent is the most targets, as a percent of the target group, a single sync may deregister.  Zero means
+	// no limit.  Removals over either limit are held for later syncs, which each remove up to the limit.
+	MaxRemovalPercent float64
+	// UnhealthyInvocationsBeforeDeregistration deregisters targets that fail health checks this many syncs in a row,
+	// even if DNS still returns them.  Zero never deregisters for health.
+	UnhealthyInvocationsBeforeDeregistration int
+	// MinTargets is how many registered targets an empty DNS answer can never remove.  Zero means no floor.
+	// state.Mapping.MinTargets overrides it per target group.
+	MinTargets int
+	// FailuresBeforeNotification is how many syncs in a row a target group must fail before Syncer.Notifier is told.
+	// Zero never notifies about failures.
+	FailuresBeforeNotification int
+	// DeregisterOnCanonicalNameChange deregisters targets missing from DNS at once, rather than after
+	// InvocationsBeforeDeregistration syncs, when a hostname's CNAME chain ends somewhere new.  The backend was
+	// replaced, so its old targets are not coming back.  Only applies to target groups with a single hostname.  Shrink
+	// limits still apply.
+	DeregisterOnCanonicalNameChange bool
 }
 
-type Resolver interface {
-	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
-}
-
-var _ Resolver = &net.Resolver{}
+type Syncer struct {
+	Log        *zapctx.Logger
+	State      state.Storage
+	Client     elbv2iface.ELBV2API
+	Config     Config
+	Resolver   Resolver
+	SyncFinder state.SyncFinder
+	// Metrics is optional
+	Metrics *metrics.Metrics
+	// Reporter is optional and is told the result of syncing each target group.  It is not called on dry runs.
+	Reporter Reporter
+	// Audit is optional and records every target registered or deregistered.  It is not called on dry runs.
+	Audit audit.Sink
+	// Notifier is optional and is told, once per sync, about changed target groups and ones that keep failing.  It is
+	// not called on dry runs.
+	Notifier notify.Notifier
+	// NewClient makes the client for target groups in another account or region.  It is only needed if a mapping has a
+	// Location, and is called once per location.
+	NewClient func(location state.Location) (elbv2iface.ELBV2API, error)
+	// ServerOptions configure the resolvers of mappings with their own DNS servers
+	ServerOptions ServerOptions
 
-type MultiResolver struct {
-	coreResolvers []*net.Resolver
-	logger        *zapctx.Logger
+	// ipAddressTypes caches the IP address type of each target group.  It cannot change after a target group is
+	// created, so it never expires.
+	ipAddressTypes map[state.TargetGroupARN]string
+	// nextSync is when SyncDue should next sync each target group
+	nextSync map[state.TargetGroupARN]time.Time
+	// mappingResolvers are the resolvers of mappings with their own DNS servers, by comma joined servers
+	mappingResolvers map[string]Resolver
+	// clients are the clients of target groups in another account or region, by location
+	clients map[state.Location]elbv2iface.ELBV2API
+	// failures is how many syncs in a row each failing target group has failed
+	failures map[state.TargetGroupARN]int
+	mu       sync.Mutex
 }
 
-func NewMultiResolver(logger *zapctx.Logger, dnsServers []string) *MultiResolver {
-	if len(dnsServers) == 0 {
-		logger.Info(context.Background(), "no dns servers in ENV: using default")
-		return &MultiResolver{
-			coreResolvers: []*net.Resolver{
-				net.DefaultResolver,
-			},
-			logger: logger,
-		}
+// withOverrides returns the config for syncing a single mapping, with the mapping's own settings in place of the
+// global ones
+func (c Config) withOverrides(mapping state.Mapping) Config {
+	if mapping.InvocationsBeforeDeregistration != nil {
+		c.InvocationsBeforeDeregistration = *mapping.InvocationsBeforeDeregistration
 	}
-	var ret MultiResolver
-	ret.logger = logger
-	for _, dnsServer := range dnsServers {
-		// Setting dnsServer is important b/c of how for work in go
-		dnsServer := dnsServer
-		ret.coreResolvers = append(ret.coreResolvers, &net.Resolver{
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				// Dial with the same network stack, but to 'dnsServer'
-				return net.Dial(network, dnsServer)
-			},
-		})
+	if mapping.RemoveUnknownTgIP != nil {
+		c.RemoveUnknownTgIP = *mapping.RemoveUnknownTgIP
 	}
-	return &ret
-}
-
-func (m *MultiResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
-	logger := m.logger.With(zap.String("host", host))
-	logger.Debug(ctx, "starting lookup")
-	idx := rand.Intn(len(m.coreResolvers))
-	var lastErr error
-	for i := 0; i < len(m.coreResolvers); i++ {
-		resolverIdx := (idx + i) % len(m.coreResolvers)
-		var ip []net.IPAddr
-		ip, lastErr = m.coreResolvers[resolverIdx].LookupIPAddr(ctx, host)
-		logger.IfErr(lastErr).Warn(ctx, "unable to look up host", zap.Int("resolver_index", resolverIdx))
-		if lastErr == nil {
-			return ip, nil
-		}
+	if mapping.MinTargets != nil {
+		c.MinTargets = *mapping.MinTargets
 	}
-	logger.IfErr(lastErr).Warn(ctx, "unable to find any resolution for host")
-	return nil, lastErr
+	return c
 }
 
-var _ Resolver = &MultiResolver{}
-
-type Syncer struct {
-	Log        *zapctx.Logger
-	State      state.Storage
-	Client     elbv2iface.ELBV2API
-	Config     Config
-	Resolver   Resolver
-	SyncFinder state.SyncFinder
+// Reporter is told the result of syncing a single target group.  plan is nil if err is set.
+type Reporter interface {
+	ReportSync(ctx context.Context, targetGroupARN state.TargetGroupARN, plan *Plan, err error)
 }
 
 func (s *Syncer) Sync(ctx context.Context) error {
@@ -91,141 +119,600 @@ func (s *Syncer) Sync(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("unable to get tg to sync: %w", err)
 	}
-	currentStates, err := s.State.GetStates(ctx, getSyncKeys(toSyncMap))
+	return s.syncMappings(ctx, toSyncMap)
+}
+
+// syncMappings syncs each target group in toSyncMap and stores the results
+func (s *Syncer) syncMappings(ctx context.Context, toSyncMap map[state.TargetGroupARN]state.Mapping) error {
+	start := time.Now()
+	defer func() {
+		s.Metrics.ObserveSync(time.Since(start))
+	}()
+	currentStates, err := s.getStates(ctx, toSyncMap)
 	if err != nil {
-		return fmt.Errorf("unable to get any states: %w", err)
+		return err
 	}
-	s.Log.Debug(ctx, "fetched states", zap.Int("len_states", len(currentStates)))
-	allResults := make(map[state.Keys]state.State, len(toSyncMap))
-	for tgArn, hostname := range toSyncMap {
-		singleResult, err := s.syncSingle(ctx, tgArn, hostname, currentStates[state.Keys{
-			TargetGroupARN: tgArn,
-			Hostname:       hostname,
-		}])
-		if err != nil {
-			s.Log.Warn(ctx, "unable to run sync", zap.String("tg", string(tgArn)), zap.String("hostname", hostname))
-		} else {
-			allResults[state.Keys{
-				TargetGroupARN: tgArn,
-				Hostname:       hostname,
-			}] = *singleResult
-		}
+	allResults := s.syncAll(ctx, toSyncMap, currentStates)
+	if s.Config.DryRun {
+		s.Log.Debug(ctx, "dry run: not storing results")
+		return nil
 	}
 	err = s.State.Store(ctx, allResults)
+	for attempt := 0; attempt < maxStoreConflictRetries; attempt++ {
+		var conflictErr *state.VersionConflictError
+		if !errors.As(err, &conflictErr) {
+			break
+		}
+		s.Log.Info(ctx, "state changed while syncing: recomputing conflicting states", zap.Int("conflicts", len(conflictErr.Keys)), zap.Int("attempt", attempt))
+		err = s.retryConflicts(ctx, toSyncMap, conflictErr.Keys)
+	}
 	if err != nil {
 		return fmt.Errorf("unable to store final results: %w", err)
 	}
 	return nil
 }
 
-func getSyncKeys(syncMap map[state.TargetGroupARN]string) []state.Keys {
+// maxStoreConflictRetries is how many times Sync recomputes the state of target groups another writer changed
+const maxStoreConflictRetries = 3
+
+// retryConflicts re-reads the state of conflicting keys, recomputes the state to store from it, and stores the results.
+// The target groups were already changed, audited, and notified about, so only the stored state is recomputed.  Changes
+// the new plan would make are left for the next sync, and targets it would remove stay tracked until then.
+func (s *Syncer) retryConflicts(ctx context.Context, toSyncMap map[state.TargetGroupARN]state.Mapping, conflicts []state.Keys) error {
+	currentStates, err := s.State.GetStates(ctx, conflicts)
+	if err != nil {
+		return fmt.Errorf("unable to re-read conflicting states: %w", err)
+	}
+	toRetry := make(map[state.TargetGroupARN]state.Mapping, len(conflicts))
+	for _, k := range conflicts {
+		if mapping, exists := toSyncMap[k.TargetGroupARN]; exists {
+			toRetry[k.TargetGroupARN] = mapping
+		}
+	}
+	results := make(map[state.Keys]state.State, len(toRetry))
+	var mu sync.Mutex
+	s.forEachTargetGroup(ctx, toRetry, func(tgCtx context.Context, tgArn state.TargetGroupARN, mapping state.Mapping, key state.Keys) {
+		var plan *Plan
+		client, err := s.clientFor(mapping)
+		if err == nil {
+			plan, err = s.planSingle(tgCtx, client, tgArn, mapping, currentStates[key])
+		}
+		if err != nil {
+			s.Log.IfErr(err).Warn(ctx, "unable to recompute conflicting state", zap.String("tg", string(tgArn)), zap.String("hostnames", key.Hostnames))
+			return
+		}
+		newState := holdTargets(plan.NewState, plan.ToRemove, plan.InvocationsBeforeDeregistration)
+		mu.Lock()
+		results[key] = newState
+		mu.Unlock()
+	})
+	return s.State.Store(ctx, results)
+}
+
+// syncAll syncs every target group and returns the new state of the ones that synced successfully
+func (s *Syncer) syncAll(ctx context.Context, toSyncMap map[state.TargetGroupARN]state.Mapping, currentStates map[state.Keys]state.State) map[state.Keys]state.State {
+	allResults := make(map[state.Keys]state.State, len(toSyncMap))
+	var notification notify.Notification
+	var mu sync.Mutex
+	s.forEachTargetGroup(ctx, toSyncMap, func(tgCtx context.Context, tgArn state.TargetGroupARN, mapping state.Mapping, key state.Keys) {
+		plan, err := s.syncSingle(tgCtx, tgArn, mapping, currentStates[key])
+		s.Metrics.TargetGroupSynced(string(tgArn), err)
+		if s.Reporter != nil && !s.Config.DryRun {
+			// Not tgCtx: a target group that timed out should still report it
+			s.Reporter.ReportSync(ctx, tgArn, plan, err)
+		}
+		if err != nil {
+			s.scheduleNext(tgArn, 0, err)
+			s.Log.IfErr(err).Warn(ctx, "unable to run sync", zap.String("tg", string(tgArn)), zap.String("hostnames", key.Hostnames))
+			if failure := s.syncFailed(tgArn, mapping, err); failure != nil {
+				mu.Lock()
+				notification.Failures = append(notification.Failures, *failure)
+				mu.Unlock()
+			}
+			return
+		}
+		s.scheduleNext(tgArn, plan.TTL, nil)
+		change := s.syncSucceeded(tgArn, plan)
+		mu.Lock()
+		allResults[key] = plan.NewState
+		if change != nil {
+			notification.Changes = append(notification.Changes, *change)
+		}
+		mu.Unlock()
+	})
+	s.sendNotification(ctx, notification)
+	return allResults
+}
+
+// forEachTargetGroup calls syncFunc for every target group, using up to Config.Concurrency goroutines.  Each call gets
+// its own context bounded by Config.TargetGroupTimeout, so one slow target group cannot hold up the rest.
+func (s *Syncer) forEachTargetGroup(ctx context.Context, toSyncMap map[state.TargetGroupARN]state.Mapping, syncFunc func(ctx context.Context, tgArn state.TargetGroupARN, mapping state.Mapping, key state.Keys)) {
+	workers := s.Config.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(toSyncMap) {
+		workers = len(toSyncMap)
+	}
+	jobs := make(chan state.TargetGroupARN)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tgArn := range jobs {
+				mapping := toSyncMap[tgArn]
+				key := state.NewKeys(tgArn, mapping.Hostnames)
+				mapping.Hostnames = key.HostnameList()
+				tgCtx, cancel := s.targetGroupContext(ctx)
+				syncFunc(tgCtx, tgArn, mapping, key)
+				cancel()
+			}
+		}()
+	}
+	for tgArn := range toSyncMap {
+		jobs <- tgArn
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (s *Syncer) targetGroupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Config.TargetGroupTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.Config.TargetGroupTimeout)
+}
+
+func getSyncKeys(syncMap map[state.TargetGroupARN]state.Mapping) []state.Keys {
 	ret := make([]state.Keys, 0, len(syncMap))
 	for k, v := range syncMap {
-		ret = append(ret, state.Keys{
-			TargetGroupARN: k,
-			Hostname:       v,
-		})
+		ret = append(ret, state.NewKeys(k, v.Hostnames))
 	}
 	return ret
 }
 
+// TargetKey identifies a target while diffing.  Targets without a port are compared by IP alone, so the target group's
+// default port never looks like a change.
+func TargetKey(ip string, port int64) string {
+	if port == 0 {
+		return ip
+	}
+	return net.JoinHostPort(ip, strconv.FormatInt(port, 10))
+}
+
+func splitTargetKey(key string) (string, int64) {
+	host, portStr, err := net.SplitHostPort(key)
+	if err != nil {
+		return key, 0
+	}
+	port, err := strconv.ParseInt(portStr, 10, 64)
+	if err != nil {
+		return key, 0
+	}
+	return host, port
+}
+
+// normalizeIP makes IPv6 addresses comparable no matter how they were written
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
 func targetsToTimesMissed(t []state.Target) map[string]int {
 	ret := make(map[string]int, len(t))
 	for i := range t {
-		ret[t[i].IP] = t[i].TimesMissing
+		ret[TargetKey(t[i].IP, t[i].Port)] = t[i].TimesMissing
+	}
+	return ret
+}
+
+// resolverFor returns the resolver of a mapping: its own DNS servers if it has any, otherwise Syncer.Resolver
+func (s *Syncer) resolverFor(mapping state.Mapping) (Resolver, error) {
+	if len(mapping.DNSServers) == 0 {
+		return s.Resolver, nil
+	}
+	key := strings.Join(mapping.DNSServers, ",")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, exists := s.mappingResolvers[key]; exists {
+		return existing, nil
+	}
+	ret, err := NewMultiResolver(s.Log.With(zap.String("servers", key)), mapping.DNSServers, s.ServerOptions)
+	if err != nil {
+		return nil, err
+	}
+	ret.Metrics = s.Metrics
+	if s.mappingResolvers == nil {
+		s.mappingResolvers = make(map[string]Resolver)
+	}
+	s.mappingResolvers[key] = ret
+	return ret, nil
+}
+
+// defaultResolverName is the ResolverStatus key of Syncer.Resolver
+const defaultResolverName = "default"
+
+// ResolverStatus returns the health of the DNS servers of Syncer.Resolver, as "default", and of mappings with their own
+// DNS servers, by the comma joined servers
+func (s *Syncer) ResolverStatus() map[string][]ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string][]ServerStatus, len(s.mappingResolvers)+1)
+	if multi, ok := s.Resolver.(*MultiResolver); ok {
+		ret[defaultResolverName] = multi.ServerStatus()
+	}
+	for key, resolver := range s.mappingResolvers {
+		if multi, ok := resolver.(*MultiResolver); ok {
+			ret[key] = multi.ServerStatus()
+		}
 	}
 	return ret
 }
 
-func (s *Syncer) resolveIPs(ctx context.Context, hostname string) ([]string, error) {
-	addrs, err := s.Resolver.LookupIPAddr(ctx, hostname)
+// clientFor returns the client of a mapping's target group: one for its location if it has one, otherwise Syncer.Client
+func (s *Syncer) clientFor(mapping state.Mapping) (elbv2iface.ELBV2API, error) {
+	if mapping.Location == (state.Location{}) {
+		return s.Client, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, exists := s.clients[mapping.Location]; exists {
+		return existing, nil
+	}
+	if s.NewClient == nil {
+		return nil, fmt.Errorf("no client for location %s", mapping.Location)
+	}
+	ret, err := s.NewClient(mapping.Location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make client for location %s: %w", mapping.Location, err)
+	}
+	if s.clients == nil {
+		s.clients = make(map[state.Location]elbv2iface.ELBV2API)
+	}
+	s.clients[mapping.Location] = ret
+	return ret, nil
+}
+
+// lookup resolves hostname, including the TTL of the answer if the resolver reports one
+func lookup(ctx context.Context, resolver Resolver, hostname string) (*Answer, error) {
+	if recordResolver, ok := resolver.(RecordResolver); ok {
+		return recordResolver.Resolve(ctx, hostname)
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return &Answer{
+		Addrs:        addrs,
+		ChainUnknown: true,
+	}, nil
+}
+
+// resolution is the IPs of one or more hostnames
+type resolution struct {
+	IPs []string
+	// SRVTargets are the IP:port target keys of SRV hostnames
+	SRVTargets []string
+	// TTL is the shortest TTL of the answers.  Zero if unknown.
+	TTL time.Duration
+	// Servers are the DNS servers that answered, if known
+	Servers []string
+	// Chains are the CNAME chains of hostnames that are a CNAME, by hostname
+	Chains map[string][]string
+	// UnknownChains are hostnames the resolver could not tell were a CNAME
+	UnknownChains []string
+}
+
+func (s *Syncer) resolveIPs(ctx context.Context, resolver Resolver, hostname string, ipv6 bool) (*resolution, error) {
+	// Only ask for the target group's family, so a failing lookup of the other cannot fail the sync
+	ans, err := lookup(withAddressFamily(ctx, ipv6), resolver, hostname)
 	if err != nil {
 		return nil, fmt.Errorf("unable to resolve IP for %s: %w", hostname, err)
 	}
-	// Fetch all the IPv4 addresses
+	addrs := ans.Addrs
+	// Fetch all the addresses of the target group's family
 	allIPs := make([]string, 0, len(addrs))
 	for _, addr := range addrs {
-		asIPv4 := addr.IP.To4()
-		if asIPv4.IsUnspecified() {
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			continue
+		}
+		isIPv4 := addr.IP.To4() != nil
+		if isIPv4 == ipv6 {
 			continue
 		}
-		allIPs = append(allIPs, asIPv4.String())
+		if isIPv4 {
+			allIPs = append(allIPs, addr.IP.To4().String())
+		} else {
+			allIPs = append(allIPs, addr.IP.String())
+		}
+	}
+	s.Log.Debug(ctx, "resolved hostname", zap.String("hostname", hostname), zap.Strings("ips", allIPs), zap.Bool("ipv6", ipv6), zap.Duration("ttl", ans.TTL), zap.String("server", ans.Server), zap.Strings("cname_chain", ans.Chain))
+	ret := &resolution{
+		IPs: allIPs,
+		TTL: ans.TTL,
 	}
-	s.Log.Debug(ctx, "resolved hostname", zap.String("hostname", hostname), zap.Strings("ips", allIPs))
-	return allIPs, nil
+	if len(ans.Chain) > 0 {
+		ret.Chains = map[string][]string{hostname: ans.Chain}
+	}
+	if ans.ChainUnknown {
+		ret.UnknownChains = []string{hostname}
+	}
+	if ans.Server != "" {
+		ret.Servers = strings.Split(ans.Server, ",")
+	}
+	return ret, nil
 }
 
-func (s *Syncer) getTargetGroupIPs(ctx context.Context, targetGroupARN state.TargetGroupARN) ([]string, error) {
-	out, err := s.Client.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+// resolveAllIPs returns the union of IPs for every hostname, and the shortest TTL among them.  If any hostname fails to
+// resolve, the whole lookup fails so a partial answer is never mistaken for IPs going missing.
+func (s *Syncer) resolveAllIPs(ctx context.Context, resolver Resolver, hostnames []string, ipv6 bool) (*resolution, error) {
+	seen := make(map[string]struct{})
+	seenServers := make(map[string]struct{})
+	ret := &resolution{
+		IPs: make([]string, 0, len(hostnames)),
+	}
+	for _, hostname := range hostnames {
+		var res *resolution
+		var err error
+		if strings.HasPrefix(hostname, state.SRVPrefix) {
+			res, err = s.resolveSRV(ctx, resolver, strings.TrimPrefix(hostname, state.SRVPrefix), ipv6)
+		} else {
+			res, err = s.resolveIPs(ctx, resolver, hostname, ipv6)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret.TTL = minTTL(ret.TTL, res.TTL)
+		ret.IPs = appendUnseen(ret.IPs, seen, res.IPs)
+		ret.SRVTargets = appendUnseen(ret.SRVTargets, seen, res.SRVTargets)
+		ret.Servers = appendUnseen(ret.Servers, seenServers, res.Servers)
+		for h, chain := range res.Chains {
+			if ret.Chains == nil {
+				ret.Chains = make(map[string][]string)
+			}
+			ret.Chains[h] = chain
+		}
+		ret.UnknownChains = append(ret.UnknownChains, res.UnknownChains...)
+	}
+	sort.Strings(ret.Servers)
+	return ret, nil
+}
+
+// resolveSRV resolves the targets of the preferred SRV records of name into IP:port target keys
+func (s *Syncer) resolveSRV(ctx context.Context, resolver Resolver, name string, ipv6 bool) (*resolution, error) {
+	srvResolver, ok := resolver.(SRVResolver)
+	if !ok {
+		return nil, fmt.Errorf("resolver cannot look up SRV records for %s", name)
+	}
+	ans, err := resolveSRVWith(ctx, srvResolver, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up SRV records for %s: %w", name, err)
+	}
+	// The targets are only valid while the SRV records are
+	ret := &resolution{
+		TTL: ans.TTL,
+	}
+	seen := make(map[string]struct{})
+	seenServers := make(map[string]struct{})
+	for _, record := range preferredSRV(ans.Records) {
+		res, err := s.resolveIPs(ctx, resolver, strings.TrimSuffix(record.Target, "."), ipv6)
+		if err != nil {
+			return nil, err
+		}
+		ret.TTL = minTTL(ret.TTL, res.TTL)
+		keys := make([]string, 0, len(res.IPs))
+		for _, ip := range res.IPs {
+			keys = append(keys, TargetKey(ip, int64(record.Port)))
+		}
+		ret.SRVTargets = appendUnseen(ret.SRVTargets, seen, keys)
+		ret.Servers = appendUnseen(ret.Servers, seenServers, res.Servers)
+	}
+	s.Log.Debug(ctx, "resolved SRV records", zap.String("name", name), zap.Strings("targets", ret.SRVTargets))
+	return ret, nil
+}
+
+// preferredSRV returns the records a client would use: those with the lowest priority.  ELB cannot weight targets, so
+// weights only decide whether a target is used at all: zero weight records are skipped unless every record has zero
+// weight.
+func preferredSRV(records []*net.SRV) []*net.SRV {
+	if len(records) == 0 {
+		return nil
+	}
+	lowest := records[0].Priority
+	for _, r := range records {
+		if r.Priority < lowest {
+			lowest = r.Priority
+		}
+	}
+	var ret []*net.SRV
+	var weighted []*net.SRV
+	for _, r := range records {
+		if r.Priority != lowest {
+			continue
+		}
+		ret = append(ret, r)
+		if r.Weight > 0 {
+			weighted = append(weighted, r)
+		}
+	}
+	if len(weighted) > 0 {
+		return weighted
+	}
+	return ret
+}
+
+// appendUnseen appends the values not already in seen to list
+func appendUnseen(list []string, seen map[string]struct{}, values []string) []string {
+	for _, v := range values {
+		if _, exists := seen[v]; exists {
+			continue
+		}
+		seen[v] = struct{}{}
+		list = append(list, v)
+	}
+	return list
+}
+
+// isIPv6TargetGroup returns true if the target group only accepts IPv6 targets
+func (s *Syncer) isIPv6TargetGroup(ctx context.Context, client elbv2iface.ELBV2API, targetGroupARN state.TargetGroupARN) (bool, error) {
+	s.mu.Lock()
+	ipAddressType, exists := s.ipAddressTypes[targetGroupARN]
+	s.mu.Unlock()
+	if exists {
+		return ipAddressType == elbv2.TargetGroupIpAddressTypeEnumIpv6, nil
+	}
+	out, err := client.DescribeTargetGroupsWithContext(ctx, &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{aws.String(string(targetGroupARN))},
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to describe target group %s: %w", targetGroupARN, err)
+	}
+	if len(out.TargetGroups) == 0 {
+		return false, fmt.Errorf("unable to find target group %s", targetGroupARN)
+	}
+	// Target groups created before dualstack support have no type and are IPv4
+	ipAddressType = aws.StringValue(out.TargetGroups[0].IpAddressType)
+	s.mu.Lock()
+	if s.ipAddressTypes == nil {
+		s.ipAddressTypes = make(map[state.TargetGroupARN]string)
+	}
+	s.ipAddressTypes[targetGroupARN] = ipAddressType
+	s.mu.Unlock()
+	return ipAddressType == elbv2.TargetGroupIpAddressTypeEnumIpv6, nil
+}
+
+// getTargetGroupTargets returns the registered targets of a target group with their health.  Draining targets are
+// skipped: they are already being deregistered, and if DNS returns them again they should be registered again.
+func (s *Syncer) getTargetGroupTargets(ctx context.Context, client elbv2iface.ELBV2API, targetGroupARN state.TargetGroupARN, comparePort bool) (map[string]*elbv2.TargetHealthDescription, error) {
+	out, err := client.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
 		TargetGroupArn: aws.String(string(targetGroupARN)),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to describe target group %s: %w", targetGroupARN, err)
 	}
-	ret := make([]string, 0, len(out.TargetHealthDescriptions))
+	ret := make(map[string]*elbv2.TargetHealthDescription, len(out.TargetHealthDescriptions))
 	for _, target := range out.TargetHealthDescriptions {
-		ret = append(ret, *target.Target.Id)
+		if targetHealthState(target) == elbv2.TargetHealthStateEnumDraining {
+			s.Log.Debug(ctx, "skipping draining target", zap.String("targetgroup_arn", string(targetGroupARN)), zap.String("id", aws.StringValue(target.Target.Id)))
+			continue
+		}
+		var port int64
+		if comparePort {
+			port = aws.Int64Value(target.Target.Port)
+		}
+		ret[TargetKey(normalizeIP(*target.Target.Id), port)] = target
 	}
 	return ret, nil
 }
 
-func (s *Syncer) syncSingle(ctx context.Context, targetGroupARN state.TargetGroupARN, hostname string, previousResult state.State) (*state.State, error) {
-	thisLogger := s.Log.With(zap.String("targetgroup_arn", string(targetGroupARN)), zap.String("hostname", hostname))
+func (s *Syncer) syncSingle(ctx context.Context, targetGroupARN state.TargetGroupARN, mapping state.Mapping, previousResult state.State) (*Plan, error) {
+	thisLogger := s.Log.With(zap.String("targetgroup_arn", string(targetGroupARN)), zap.Strings("hostnames", mapping.Hostnames))
 	thisLogger.Debug(ctx, "<- syncSingle")
 	defer s.Log.Debug(ctx, "-> syncSingle")
-	allIPs, err := s.resolveIPs(ctx, hostname)
+	client, err := s.clientFor(mapping)
 	if err != nil {
-		return nil, fmt.Errorf("unable to resolve IP for %s: %w", hostname, err)
+		return nil, err
 	}
-	currentlyStoredIPs, err := s.getTargetGroupIPs(ctx, targetGroupARN)
+	plan, err := s.planSingle(ctx, client, targetGroupARN, mapping, previousResult)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get target group IPs %s: %w", targetGroupARN, err)
+		return nil, err
 	}
-	thisLogger.Debug(ctx, "found current IPs", zap.Strings("ips", currentlyStoredIPs))
-
-	ipToRemove, ipToAdd, newState := resolve(previousResult, currentlyStoredIPs, allIPs, s.Config.InvocationsBeforeDeregistration, s.Config.RemoveUnknownTgIP)
-	if len(ipToAdd) > 0 {
-		thisLogger.Info(ctx, "adding IPs", zap.Strings("ips", ipToAdd))
-		_, err = s.Client.RegisterTargetsWithContext(ctx, &elbv2.RegisterTargetsInput{
+	for _, change := range plan.CanonicalNameChanges {
+		thisLogger.Warn(ctx, "CNAME target changed", zap.String("hostname", change.Hostname), zap.String("previous", change.Previous), zap.String("current", change.Current), zap.Strings("cname_chain", plan.CNAMEChains[change.Hostname]), zap.Bool("deregister_immediately", plan.DeregisterImmediately), zap.Bool("dry_run", s.Config.DryRun))
+		if !s.Config.DryRun {
+			s.Metrics.CanonicalNameChanged(string(targetGroupARN))
+		}
+	}
+	if len(plan.HeldRemovals) > 0 {
+		thisLogger.Warn(ctx, "holding removals", zap.String("reason", plan.HoldReason), zap.Strings("ips", plan.HeldRemovals), zap.Int("current_targets", len(plan.currentTargets)), zap.Bool("dry_run", s.Config.DryRun))
+		if !s.Config.DryRun {
+			s.Metrics.RemovalsHeld(string(targetGroupARN), plan.HoldReason, len(plan.HeldRemovals))
+		}
+	}
+	if s.Config.DryRun {
+		if len(plan.ToAdd) > 0 || len(plan.ToRemove) > 0 {
+			thisLogger.Info(ctx, "dry run: would change targets", zap.Strings("add", plan.ToAdd), zap.Strings("remove", plan.ToRemove))
+		}
+		return plan, nil
+	}
+	if len(plan.ToAdd) > 0 {
+		thisLogger.Info(ctx, "adding IPs", zap.Strings("ips", plan.ToAdd))
+		_, err = client.RegisterTargetsWithContext(ctx, &elbv2.RegisterTargetsInput{
 			TargetGroupArn: aws.String(string(targetGroupARN)),
-			Targets:        createTargets(ipToAdd),
+			Targets:        createTargets(plan.ToAdd, mapping.AvailabilityZone),
 		})
 		if err != nil {
-			s.Log.IfErr(err).Warn(ctx, "unable to register targets", zap.Strings("targets", ipToAdd))
+			s.Log.IfErr(err).Warn(ctx, "unable to register targets", zap.Strings("targets", plan.ToAdd))
 			return nil, fmt.Errorf("unable to register targets with %s: %w", targetGroupARN, err)
 		}
+		s.recordAudit(ctx, targetGroupARN, plan, audit.ActionRegister, plan.ToAdd)
 	}
-	if len(ipToRemove) > 0 {
-		thisLogger.Info(ctx, "removing IPs", zap.Strings("ips", ipToAdd))
-		_, err = s.Client.DeregisterTargetsWithContext(ctx, &elbv2.DeregisterTargetsInput{
+	if len(plan.ToRemove) > 0 {
+		thisLogger.Info(ctx, "removing IPs", zap.Strings("ips", plan.ToRemove))
+		_, err = client.DeregisterTargetsWithContext(ctx, &elbv2.DeregisterTargetsInput{
 			TargetGroupArn: aws.String(string(targetGroupARN)),
-			Targets:        createTargets(ipToRemove),
+			Targets:        removalTargets(plan.ToRemove, plan.currentTargets),
 		})
 		if err != nil {
-			s.Log.IfErr(err).Warn(ctx, "unable to deregister targets", zap.Strings("targets", ipToRemove))
+			s.Log.IfErr(err).Warn(ctx, "unable to deregister targets", zap.Strings("targets", plan.ToRemove))
 			return nil, fmt.Errorf("unable to deregister targets with %s: %w", targetGroupARN, err)
 		}
+		s.recordAudit(ctx, targetGroupARN, plan, audit.ActionDeregister, plan.ToRemove)
 	}
-	return &newState, nil
+	s.Metrics.TargetsChanged(string(targetGroupARN), len(plan.ToAdd), len(plan.ToRemove))
+	return plan, nil
 }
 
 func createNewState(tm map[string]int) state.State {
 	var ret state.State
-	for ip, misses := range tm {
+	for key, misses := range tm {
+		ip, port := splitTargetKey(key)
 		ret.Targets = append(ret.Targets, state.Target{
 			IP:           ip,
+			Port:         port,
 			TimesMissing: misses,
 		})
 	}
+	sortTargets(ret.Targets)
 	return ret
 }
 
-func createTargets(add []string) []*elbv2.TargetDescription {
+func sortTargets(targets []state.Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		return TargetKey(targets[i].IP, targets[i].Port) < TargetKey(targets[j].IP, targets[j].Port)
+	})
+}
+
+func createTargets(add []string, availabilityZone string) []*elbv2.TargetDescription {
 	ret := make([]*elbv2.TargetDescription, len(add))
 	for i := range add {
+		ip, port := splitTargetKey(add[i])
 		ret[i] = &elbv2.TargetDescription{
-			Id: aws.String(add[i]),
+			Id: aws.String(ip),
+		}
+		if port != 0 {
+			ret[i].Port = aws.Int64(port)
+		}
+		if availabilityZone != "" {
+			ret[i].AvailabilityZone = aws.String(availabilityZone)
+		}
+	}
+	return ret
+}
+
+// removalTargets prefers the target description ELB returned, so targets are deregistered with the exact port they
+// were registered with
+func removalTargets(remove []string, currentTargets map[string]*elbv2.TargetHealthDescription) []*elbv2.TargetDescription {
+	ret := make([]*elbv2.TargetDescription, 0, len(remove))
+	for _, key := range remove {
+		if existing, exists := currentTargets[key]; exists {
+			ret = append(ret, existing.Target)
+			continue
 		}
+		ret = append(ret, createTargets([]string{key}, "")...)
 	}
 	return ret
 }
@@ -2,12 +2,226 @@ package syncer
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 	"github.com/cresta/hostname-for-target-group/internal/state"
+	"github.com/cresta/zapctx/testhelp/testhelp"
 	"github.com/stretchr/testify/require"
 )
 
+type staticResolver map[string][]net.IPAddr
+
+func (s staticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ret, exists := s[host]
+	if !exists {
+		return nil, errors.New("no such host")
+	}
+	return ret, nil
+}
+
+// blockingResolver blocks lookups of host until the context is done
+type blockingResolver struct {
+	Resolver
+	host string
+}
+
+func (b blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == b.host {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.Resolver.LookupIPAddr(ctx, host)
+}
+
+func ipAddrs(ips ...string) []net.IPAddr {
+	ret := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return ret
+}
+
+type fakeELB struct {
+	elbv2iface.ELBV2API
+	ipAddressType string
+	targets       []*elbv2.TargetDescription
+	// health is the health state of each target, by ID
+	health       map[string]string
+	registered   []*elbv2.TargetDescription
+	deregistered []*elbv2.TargetDescription
+	mu           sync.Mutex
+}
+
+func (f *fakeELB) DescribeTargetGroupsWithContext(_ aws.Context, in *elbv2.DescribeTargetGroupsInput, _ ...request.Option) (*elbv2.DescribeTargetGroupsOutput, error) {
+	tg := &elbv2.TargetGroup{
+		TargetGroupArn: in.TargetGroupArns[0],
+	}
+	if f.ipAddressType != "" {
+		tg.IpAddressType = aws.String(f.ipAddressType)
+	}
+	return &elbv2.DescribeTargetGroupsOutput{
+		TargetGroups: []*elbv2.TargetGroup{tg},
+	}, nil
+}
+
+func (f *fakeELB) DescribeTargetHealthWithContext(_ aws.Context, _ *elbv2.DescribeTargetHealthInput, _ ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	ret := &elbv2.DescribeTargetHealthOutput{}
+	for _, t := range f.targets {
+		desc := &elbv2.TargetHealthDescription{
+			Target: t,
+		}
+		if health, exists := f.health[*t.Id]; exists {
+			desc.TargetHealth = &elbv2.TargetHealth{
+				State: aws.String(health),
+			}
+		}
+		ret.TargetHealthDescriptions = append(ret.TargetHealthDescriptions, desc)
+	}
+	return ret, nil
+}
+
+func (f *fakeELB) RegisterTargetsWithContext(_ aws.Context, in *elbv2.RegisterTargetsInput, _ ...request.Option) (*elbv2.RegisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.registered = append(f.registered, in.Targets...)
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *fakeELB) DeregisterTargetsWithContext(_ aws.Context, in *elbv2.DeregisterTargetsInput, _ ...request.Option) (*elbv2.DeregisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deregistered = append(f.deregistered, in.Targets...)
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func TestSyncSinglePortChange(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4"), Port: aws.Int64(80)},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			RemoveUnknownTgIP: true,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+	}
+	mapping := state.Mapping{
+		Hostnames:        []string{"a.example.com"},
+		Port:             8443,
+		AvailabilityZone: state.AvailabilityZoneAll,
+	}
+	plan, err := s.syncSingle(context.Background(), "arn:test", mapping, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []*elbv2.TargetDescription{
+		{Id: aws.String("1.2.3.4"), Port: aws.Int64(8443), AvailabilityZone: aws.String("all")},
+	}, client.registered)
+	require.Equal(t, []*elbv2.TargetDescription{
+		{Id: aws.String("1.2.3.4"), Port: aws.Int64(80)},
+	}, client.deregistered)
+	require.Equal(t, []state.Target{
+		{IP: "1.2.3.4", Port: 8443, AvailabilityZone: "all"},
+	}, plan.NewState.Targets)
+}
+
+func TestSyncSingleDefaultPort(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4"), Port: aws.Int64(80)},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+	}
+	_, err := s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"a.example.com"}}, state.State{})
+	require.NoError(t, err)
+	require.Empty(t, client.registered)
+	require.Empty(t, client.deregistered)
+}
+
+func TestResolveAllIPs(t *testing.T) {
+	s := &Syncer{
+		Log: testhelp.ZapTestingLogger(t),
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4", "1.2.3.5"),
+			"b.example.com": ipAddrs("1.2.3.5", "1.2.3.6"),
+		},
+	}
+	res, err := s.resolveAllIPs(context.Background(), s.Resolver, []string{"a.example.com", "b.example.com"}, false)
+	require.NoError(t, err)
+	sort.Strings(res.IPs)
+	require.Equal(t, []string{"1.2.3.4", "1.2.3.5", "1.2.3.6"}, res.IPs)
+
+	_, err = s.resolveAllIPs(context.Background(), s.Resolver, []string{"a.example.com", "missing.example.com"}, false)
+	require.Error(t, err)
+}
+
+func TestResolveIPsMixedFamilies(t *testing.T) {
+	s := &Syncer{
+		Log: testhelp.ZapTestingLogger(t),
+		Resolver: staticResolver{
+			"dualstack.example.com": ipAddrs("1.2.3.4", "2001:db8::1", "::ffff:1.2.3.5", "2001:0db8:0000::2", "0.0.0.0", "::"),
+		},
+	}
+	res, err := s.resolveIPs(context.Background(), s.Resolver, "dualstack.example.com", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4", "1.2.3.5"}, res.IPs)
+
+	res, err = s.resolveIPs(context.Background(), s.Resolver, "dualstack.example.com", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, res.IPs)
+}
+
+func TestSyncSingleIPv6(t *testing.T) {
+	client := &fakeELB{
+		ipAddressType: elbv2.TargetGroupIpAddressTypeEnumIpv6,
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("2001:0db8::1"), Port: aws.Int64(80)},
+			{Id: aws.String("2001:db8::3"), Port: aws.Int64(80)},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			RemoveUnknownTgIP: true,
+		},
+		Resolver: staticResolver{
+			"dualstack.example.com": ipAddrs("1.2.3.4", "2001:db8::1", "2001:db8::2"),
+		},
+	}
+	plan, err := s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"dualstack.example.com"}}, state.State{})
+	require.NoError(t, err)
+	require.Equal(t, []*elbv2.TargetDescription{
+		{Id: aws.String("2001:db8::2")},
+	}, client.registered)
+	require.Equal(t, []*elbv2.TargetDescription{
+		{Id: aws.String("2001:db8::3"), Port: aws.Int64(80)},
+	}, client.deregistered)
+	require.Equal(t, []state.Target{
+		{IP: "2001:db8::1"},
+		{IP: "2001:db8::2"},
+	}, plan.NewState.Targets)
+}
+
 func TestResolve(t *testing.T) {
 	type testParams struct {
 		name                            string
@@ -167,8 +381,313 @@ func TestResolve(t *testing.T) {
 
 func TestMultiResolver(t *testing.T) {
 	ctx := context.Background()
-	m := NewMultiResolver(nil, nil)
+	m, err := NewMultiResolver(nil, nil, ServerOptions{})
+	require.NoError(t, err)
 	ip, err := m.LookupIPAddr(ctx, "www.google.com")
 	require.NoError(t, err)
 	require.True(t, len(ip) > 0)
 }
+
+type memoryStorage struct {
+	states map[state.Keys]state.State
+	stores int
+	// beforeStore simulates another writer changing state during a sync
+	beforeStore func(m *memoryStorage)
+}
+
+type staticSyncFinder map[state.TargetGroupARN]state.Mapping
+
+func (s staticSyncFinder) ToSync(_ context.Context) (map[state.TargetGroupARN]state.Mapping, error) {
+	return s, nil
+}
+
+func (m *memoryStorage) GetStates(_ context.Context, syncPairs []state.Keys) (map[state.Keys]state.State, error) {
+	ret := make(map[state.Keys]state.State, len(syncPairs))
+	for _, k := range syncPairs {
+		ret[k] = m.states[k]
+	}
+	return ret, nil
+}
+
+func (m *memoryStorage) Store(_ context.Context, toStore map[state.Keys]state.State) error {
+	m.stores++
+	if m.states == nil {
+		m.states = make(map[state.Keys]state.State)
+	}
+	if m.beforeStore != nil {
+		m.beforeStore(m)
+	}
+	var conflicts []state.Keys
+	for k, v := range toStore {
+		if m.states[k].Version != v.Version-1 {
+			conflicts = append(conflicts, k)
+			continue
+		}
+		m.states[k] = v
+	}
+	if len(conflicts) > 0 {
+		return &state.VersionConflictError{Keys: conflicts}
+	}
+	return nil
+}
+
+func TestPlanAndDryRun(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4"), Port: aws.Int64(80)},
+			{Id: aws.String("1.2.3.5"), Port: aws.Int64(80)},
+		},
+	}
+	storage := &memoryStorage{}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		State:  storage,
+		Config: Config{
+			InvocationsBeforeDeregistration: 2,
+			DryRun:                          true,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4", "1.2.3.6"),
+		},
+		SyncFinder: &state.HardCodedSyncFinder{
+			TargetGroupARN: "arn:test",
+			Mapping:        state.Mapping{Hostnames: []string{"a.example.com"}},
+		},
+	}
+	key := state.NewKeys("arn:test", []string{"a.example.com"})
+	storage.states = map[state.Keys]state.State{
+		key: createNewState(map[string]int{"1.2.3.4": 0, "1.2.3.5": 0}),
+	}
+	plans, err := s.Plan(context.Background())
+	require.NoError(t, err)
+	require.Len(t, plans, 1)
+	require.Equal(t, []string{"1.2.3.6"}, plans[0].ToAdd)
+	require.Empty(t, plans[0].ToRemove)
+	require.Equal(t, []state.Target{
+		{IP: "1.2.3.4"},
+		{IP: "1.2.3.5", TimesMissing: 1},
+		{IP: "1.2.3.6"},
+	}, plans[0].NewState.Targets)
+
+	require.NoError(t, s.Sync(context.Background()))
+	require.Empty(t, client.registered)
+	require.Empty(t, client.deregistered)
+	require.Equal(t, 0, storage.stores)
+}
+
+func TestSyncConcurrentWithTimeout(t *testing.T) {
+	client := &fakeELB{}
+	storage := &memoryStorage{}
+	finder := staticSyncFinder{
+		"arn:slow": {Hostnames: []string{"slow.example.com"}},
+	}
+	for i := 0; i < 20; i++ {
+		finder[state.TargetGroupARN(fmt.Sprintf("arn:%d", i))] = state.Mapping{Hostnames: []string{"a.example.com"}}
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		State:  storage,
+		Config: Config{
+			Concurrency:        4,
+			TargetGroupTimeout: time.Millisecond * 50,
+		},
+		Resolver: blockingResolver{
+			Resolver: staticResolver{
+				"a.example.com": ipAddrs("1.2.3.4"),
+			},
+			host: "slow.example.com",
+		},
+		SyncFinder: finder,
+	}
+	require.NoError(t, s.Sync(context.Background()))
+	require.Len(t, client.registered, 20)
+	require.Len(t, storage.states, 20)
+	require.NotContains(t, storage.states, state.NewKeys("arn:slow", []string{"slow.example.com"}))
+}
+
+func TestSyncRetriesVersionConflicts(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+		},
+	}
+	keyA := state.NewKeys("arn:a", []string{"a.example.com"})
+	keyB := state.NewKeys("arn:b", []string{"a.example.com"})
+	storage := &memoryStorage{
+		states: map[state.Keys]state.State{
+			keyA: createNewState(map[string]int{"1.2.3.4": 0, "1.2.3.5": 0}),
+			keyB: createNewState(map[string]int{"1.2.3.4": 0, "1.2.3.5": 0}),
+		},
+	}
+	storage.beforeStore = func(m *memoryStorage) {
+		// Another writer counts a miss for arn:a first
+		if m.stores == 1 {
+			m.states[keyA] = state.State{
+				Targets: []state.Target{{IP: "1.2.3.4"}, {IP: "1.2.3.5", TimesMissing: 1}},
+				Version: 1,
+			}
+		}
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		State:  storage,
+		Config: Config{
+			InvocationsBeforeDeregistration: 3,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+		SyncFinder: staticSyncFinder{
+			"arn:a": {Hostnames: []string{"a.example.com"}},
+			"arn:b": {Hostnames: []string{"a.example.com"}},
+		},
+	}
+	require.NoError(t, s.Sync(context.Background()))
+	require.Equal(t, 2, storage.stores)
+	require.Equal(t, state.State{
+		Targets: []state.Target{{IP: "1.2.3.4"}, {IP: "1.2.3.5", TimesMissing: 2}},
+		Version: 2,
+	}, storage.states[keyA])
+	require.Equal(t, state.State{
+		Targets: []state.Target{{IP: "1.2.3.4"}, {IP: "1.2.3.5", TimesMissing: 1}},
+		Version: 1,
+	}, storage.states[keyB])
+}
+
+func TestSyncSingleMappingOverrides(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+			{Id: aws.String("9.9.9.9")},
+		},
+	}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		Config: Config{
+			InvocationsBeforeDeregistration: 3,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+	}
+	one := 1
+	yes := true
+	mapping := state.Mapping{
+		Hostnames:                       []string{"a.example.com"},
+		InvocationsBeforeDeregistration: &one,
+		RemoveUnknownTgIP:               &yes,
+	}
+	previous := state.State{
+		Targets: []state.Target{
+			{IP: "1.2.3.4"},
+			{IP: "1.2.3.5"},
+		},
+	}
+	plan, err := s.syncSingle(context.Background(), "arn:test", mapping, previous)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.5", "9.9.9.9"}, plan.ToRemove)
+
+	// Without overrides, the global config keeps both
+	plan, err = s.syncSingle(context.Background(), "arn:test", state.Mapping{Hostnames: []string{"a.example.com"}}, previous)
+	require.NoError(t, err)
+	require.Empty(t, plan.ToRemove)
+}
+
+func TestSyncSingleLocation(t *testing.T) {
+	defaultClient := &fakeELB{}
+	remoteClient := &fakeELB{}
+	remote := state.Location{Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/sync"}
+	var made []state.Location
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: defaultClient,
+		NewClient: func(location state.Location) (elbv2iface.ELBV2API, error) {
+			made = append(made, location)
+			if location != remote {
+				return nil, errors.New("unknown location")
+			}
+			return remoteClient, nil
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4"),
+		},
+	}
+	mapping := state.Mapping{Hostnames: []string{"a.example.com"}, Location: remote}
+	for i := 0; i < 2; i++ {
+		_, err := s.syncSingle(context.Background(), "arn:remote", mapping, state.State{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []state.Location{remote}, made, "clients are cached")
+	require.Len(t, remoteClient.registered, 2)
+	require.Empty(t, defaultClient.registered)
+
+	_, err := s.syncSingle(context.Background(), "arn:default", state.Mapping{Hostnames: []string{"a.example.com"}}, state.State{})
+	require.NoError(t, err)
+	require.Len(t, defaultClient.registered, 1)
+
+	_, err = s.syncSingle(context.Background(), "arn:other", state.Mapping{Hostnames: []string{"a.example.com"}, Location: state.Location{Region: "ap-south-1"}}, state.State{})
+	require.Error(t, err)
+}
+
+func TestSyncConflictSideEffectsOnce(t *testing.T) {
+	client := &fakeELB{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("1.2.3.4")},
+			{Id: aws.String("1.2.3.5")},
+		},
+	}
+	key := state.NewKeys("arn:a", []string{"a.example.com"})
+	storage := &memoryStorage{
+		states: map[state.Keys]state.State{
+			key: createNewState(map[string]int{"1.2.3.4": 0, "1.2.3.5": 0}),
+		},
+	}
+	storage.beforeStore = func(m *memoryStorage) {
+		// Another writer counts a miss first
+		if m.stores == 1 {
+			m.states[key] = state.State{
+				Targets: []state.Target{{IP: "1.2.3.4"}, {IP: "1.2.3.5", TimesMissing: 1}},
+				Version: 1,
+			}
+		}
+	}
+	sink := &recordingSink{}
+	notifier := &recordingNotifier{}
+	s := &Syncer{
+		Log:    testhelp.ZapTestingLogger(t),
+		Client: client,
+		State:  storage,
+		Config: Config{
+			InvocationsBeforeDeregistration: 2,
+		},
+		Resolver: staticResolver{
+			"a.example.com": ipAddrs("1.2.3.4", "1.2.3.6"),
+		},
+		SyncFinder: staticSyncFinder{
+			"arn:a": {Hostnames: []string{"a.example.com"}},
+		},
+		Audit:    sink,
+		Notifier: notifier,
+	}
+	require.NoError(t, s.Sync(context.Background()))
+	require.Equal(t, 2, storage.stores)
+	require.Len(t, client.registered, 1, "the retry does not register again")
+	require.Empty(t, client.deregistered, "the retry leaves its removal for the next sync")
+	require.Len(t, sink.events, 1)
+	require.Len(t, notifier.notifications(), 1)
+	require.Equal(t, state.State{
+		Targets: []state.Target{{IP: "1.2.3.4"}, {IP: "1.2.3.5", TimesMissing: 2}, {IP: "1.2.3.6"}},
+		Version: 2,
+	}, stripHealthState(storage.states[key]))
+}
+
+func stripHealthState(st state.State) state.State {
+	st.Targets = stripHealth(st.Targets)
+	return st
+}